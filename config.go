@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"private-dns/handler"
+	"private-dns/metrics"
+	"private-dns/provider"
+)
+
+// configVersion is the apiVersion of the -config file
+const configVersion = "private-dns/v1"
+
+// fileConfig is the -config file, each setting gives the value of the flag of the same meaning, a flag given on
+// the command line takes precedence over the file
+type fileConfig struct {
+	APIVersion string `json:"apiVersion"`
+	// Source is -source
+	Source string `json:"source,omitempty"`
+	// Namespace is -namespace
+	Namespace *string `json:"namespace,omitempty"`
+	// OwnerID is -owner-id
+	OwnerID string `json:"ownerId,omitempty"`
+	// Policy is -policy
+	Policy string `json:"policy,omitempty"`
+	// AnnotationPrefix is -annotation-prefix
+	AnnotationPrefix string `json:"annotationPrefix,omitempty"`
+	// LogLevel is -v
+	LogLevel *int `json:"logLevel,omitempty"`
+	Azure *azureConfig `json:"azure,omitempty"`
+	Filters *filterConfig `json:"filters,omitempty"`
+	TTL *ttlConfig `json:"ttl,omitempty"`
+}
+
+type azureConfig struct {
+	Auth string `json:"auth,omitempty"`
+	ResourceGroup string `json:"resourceGroup,omitempty"`
+	SubscriptionID string `json:"subscriptionId,omitempty"`
+	PublicZone *bool `json:"publicZone,omitempty"`
+}
+
+type filterConfig struct {
+	Domains []string `json:"domains,omitempty"`
+	ExcludeDomains []string `json:"excludeDomains,omitempty"`
+	RegexDomainFilter string `json:"regexDomainFilter,omitempty"`
+	RegexDomainExclusion string `json:"regexDomainExclusion,omitempty"`
+	ZoneNames []string `json:"zoneNames,omitempty"`
+	ZoneTags map[string]string `json:"zoneTags,omitempty"`
+	ZoneIDs []string `json:"zoneIds,omitempty"`
+}
+
+type ttlConfig struct {
+	Default *int `json:"default,omitempty"`
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+}
+
+// staticFlags are the settings only read at startup, a reload changing one is rejected
+var staticFlags = []string{
+	"source", "namespace", "owner-id", "policy", "annotation-prefix",
+	"azure-auth", "azure-resource-group", "azure-subscription-id", "public-zone",
+}
+
+// dynamicFlags are the settings a reload applies without a restart, see dynamicSettings
+var dynamicFlags = []string{
+	"domain-filter", "exclude-domains", "regex-domain-filter", "regex-domain-exclusion",
+	"zone-name-filter", "zone-tag-filter", "zone-id-filter",
+	"default-ttl", "min-ttl", "max-ttl", "v",
+}
+
+// parseConfig returns the flag values set by a config file
+func parseConfig(data []byte) (map[string]string, error) {
+	c := fileConfig{}
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, err
+	}
+	if c.APIVersion != configVersion {
+		return nil, fmt.Errorf("apiVersion must be %s, not %q", configVersion, c.APIVersion)
+	}
+
+	values := map[string]string{}
+	setString := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	setList := func(name string, list []string) {
+		if len(list) > 0 {
+			values[name] = strings.Join(list, ",")
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			values[name] = strconv.Itoa(*value)
+		}
+	}
+
+	setString("source", c.Source)
+	if c.Namespace != nil {
+		values["namespace"] = *c.Namespace
+	}
+	setString("owner-id", c.OwnerID)
+	setString("policy", c.Policy)
+	setString("annotation-prefix", c.AnnotationPrefix)
+	setInt("v", c.LogLevel)
+	if c.Azure != nil {
+		setString("azure-auth", c.Azure.Auth)
+		setString("azure-resource-group", c.Azure.ResourceGroup)
+		setString("azure-subscription-id", c.Azure.SubscriptionID)
+		if c.Azure.PublicZone != nil {
+			values["public-zone"] = strconv.FormatBool(*c.Azure.PublicZone)
+		}
+	}
+	if c.Filters != nil {
+		setList("domain-filter", c.Filters.Domains)
+		setList("exclude-domains", c.Filters.ExcludeDomains)
+		setString("regex-domain-filter", c.Filters.RegexDomainFilter)
+		setString("regex-domain-exclusion", c.Filters.RegexDomainExclusion)
+		setList("zone-name-filter", c.Filters.ZoneNames)
+		setList("zone-id-filter", c.Filters.ZoneIDs)
+		tags := []string{}
+		for k, v := range c.Filters.ZoneTags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		setList("zone-tag-filter", tags)
+	}
+	if c.TTL != nil {
+		setInt("default-ttl", c.TTL.Default)
+		setInt("min-ttl", c.TTL.Min)
+		setInt("max-ttl", c.TTL.Max)
+	}
+	return values, nil
+}
+
+// dynamicSettings are the settings a reload applies without a restart
+type dynamicSettings struct {
+	domains  provider.DomainFilter
+	zones    provider.ZoneFilter
+	ttl      handler.TTLSettings
+	logLevel string
+}
+
+// parseDynamicSettings returns the dynamicSettings from the value of each of the dynamicFlags
+func parseDynamicSettings(value func(name string) string) (dynamicSettings, error) {
+	s := dynamicSettings{ logLevel: value("v") }
+	var err error
+
+	s.domains = provider.DomainFilter{ Include: splitList(value("domain-filter")), Exclude: splitList(value("exclude-domains")) }
+	if r := value("regex-domain-filter"); r != "" {
+		if s.domains.Regex, err = regexp.Compile(r); err != nil {
+			return s, fmt.Errorf("cannot parse -regex-domain-filter, %v", err)
+		}
+	}
+	if r := value("regex-domain-exclusion"); r != "" {
+		if s.domains.RegexExclusion, err = regexp.Compile(r); err != nil {
+			return s, fmt.Errorf("cannot parse -regex-domain-exclusion, %v", err)
+		}
+	}
+
+	s.zones = provider.ZoneFilter{ Names: splitList(value("zone-name-filter")), IDs: splitList(value("zone-id-filter")), Tags: map[string]string{} }
+	for _, tag := range splitList(value("zone-tag-filter")) {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			s.zones.Tags[kv[0]] = kv[1]
+		} else {
+			s.zones.Tags[kv[0]] = ""
+		}
+	}
+
+	for name, ttl := range map[string]*int{ "default-ttl": &s.ttl.Default, "min-ttl": &s.ttl.Min, "max-ttl": &s.ttl.Max } {
+		if *ttl, err = strconv.Atoi(value(name)); err != nil {
+			return s, fmt.Errorf("-%s must be a number of seconds", name)
+		}
+	}
+	if s.ttl.Min < 1 || s.ttl.Min > s.ttl.Max || s.ttl.Default < s.ttl.Min || s.ttl.Default > s.ttl.Max {
+		return s, fmt.Errorf("-default-ttl must be within -min-ttl and -max-ttl, and -min-ttl at least 1")
+	}
+	if _, err = strconv.Atoi(s.logLevel); err != nil {
+		return s, fmt.Errorf("-v must be a number")
+	}
+	return s, nil
+}
+
+// apply makes the settings current in the handlers & providers
+func (s dynamicSettings) apply() {
+	provider.SetFilters(s.domains, s.zones)
+	handler.SetTTLSettings(s.ttl)
+	flag.Set("v", s.logLevel)
+}
+
+// flagValue returns the current value of the flag name
+func flagValue(name string) string {
+	return flag.Lookup(name).Value.String()
+}
+
+// configWatcher reloads the -config file when it changes, eg when the ConfigMap it is mounted from is updated
+type configWatcher struct {
+	path string
+	// explicit are the flags given on the command line, the file does not override them
+	explicit map[string]bool
+	// static are the values of the staticFlags at startup
+	static map[string]string
+	last []byte
+}
+
+// loadConfig sets each flag the -config file at path gives, unless it is in explicit, and returns a
+// configWatcher to reload the file
+func loadConfig(path string, explicit map[string]bool) (*configWatcher, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s, %v", path, err)
+	}
+	for name, value := range values {
+		if explicit[name] {
+			continue
+		}
+		if err = flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid config %s, %s: %v", path, name, err)
+		}
+	}
+
+	w := &configWatcher{ path: path, explicit: explicit, static: map[string]string{}, last: data }
+	for _, name := range staticFlags {
+		w.static[name] = flagValue(name)
+	}
+	return w, nil
+}
+
+// check reloads the file if its content changed, a file that is invalid or changes a setting only read at
+// startup is rejected, and the running settings kept
+func (w *configWatcher) check() {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		klog.Errorf("Config: cannot read %s: %v", w.path, err)
+		return
+	}
+	if bytes.Equal(data, w.last) {
+		return
+	}
+	w.last = data
+
+	err = w.reload(data)
+	metrics.ConfigReloaded(err)
+	if err != nil {
+		klog.Errorf("Config: rejected the change to %s, keeping the running settings: %v", w.path, err)
+		return
+	}
+	klog.Infof("Config: applied the change to %s", w.path)
+}
+
+func (w *configWatcher) reload(data []byte) error {
+	values, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+
+	// the command line wins, then the file, then the flag's default
+	value := func(name string) string {
+		if w.explicit[name] {
+			return flagValue(name)
+		}
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return flag.Lookup(name).DefValue
+	}
+
+	for _, name := range staticFlags {
+		if v := value(name); v != w.static[name] {
+			return fmt.Errorf("changing %s from %q to %q needs a restart", name, w.static[name], v)
+		}
+	}
+
+	settings, err := parseDynamicSettings(value)
+	if err != nil {
+		return err
+	}
+	settings.apply()
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/klog/v2"
+
+	"private-dns/handler"
+	"private-dns/provider"
+)
+
+// registerConfigFlags registers the flags a reload reads, main registers them on a real start
+func registerConfigFlags() {
+	if flag.Lookup("v") == nil {
+		klog.InitFlags(nil)
+	}
+	defaults := map[string]string{
+		"policy": "sync", "annotation-prefix": handler.DefaultAnnotationPrefix, "public-zone": "false",
+		"default-ttl": "3600", "min-ttl": "1", "max-ttl": "86400",
+	}
+	for _, name := range append(append([]string{}, staticFlags...), dynamicFlags...) {
+		if flag.Lookup(name) == nil {
+			flag.String(name, defaults[name], "")
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]string
+		wantErr string
+	}{
+		{ name: "empty", data: "apiVersion: private-dns/v1\n", want: map[string]string{} },
+		{
+			name: "every setting",
+			data: `apiVersion: private-dns/v1
+source: ingress
+namespace: ""
+ownerId: cluster-a
+policy: upsert-only
+annotationPrefix: dns.corp
+logLevel: 2
+azure:
+  auth: file
+  resourceGroup: dns-rg
+  subscriptionId: sub
+  publicZone: false
+filters:
+  domains: [corp.internal, corp.example]
+  excludeDomains: [legacy.corp.internal]
+  regexDomainFilter: ^app
+  regexDomainExclusion: ^test-
+  zoneNames: [corp.internal]
+  zoneTags: { team: dns, env: prod }
+  zoneIds: [/subscriptions/sub/zone]
+ttl:
+  default: 300
+  min: 60
+  max: 600
+`,
+			want: map[string]string{
+				"source": "ingress", "namespace": "", "owner-id": "cluster-a", "policy": "upsert-only",
+				"annotation-prefix": "dns.corp", "v": "2",
+				"azure-auth": "file", "azure-resource-group": "dns-rg", "azure-subscription-id": "sub", "public-zone": "false",
+				"domain-filter": "corp.internal,corp.example", "exclude-domains": "legacy.corp.internal",
+				"regex-domain-filter": "^app", "regex-domain-exclusion": "^test-",
+				"zone-name-filter": "corp.internal", "zone-tag-filter": "env=prod,team=dns", "zone-id-filter": "/subscriptions/sub/zone",
+				"default-ttl": "300", "min-ttl": "60", "max-ttl": "600",
+			},
+		},
+		{ name: "missing apiVersion", data: "source: ingress\n", wantErr: "apiVersion must be private-dns/v1" },
+		{ name: "unknown setting", data: "apiVersion: private-dns/v1\nsources: ingress\n", wantErr: "unknown field" },
+		{ name: "not yaml", data: "apiVersion: [\n", wantErr: "yaml" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseConfig error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	registerConfigFlags()
+	defer provider.SetFilters(provider.DomainFilter{}, provider.ZoneFilter{})
+	defer handler.SetTTLSettings(handler.TTLSettings{ Default: 3600, Min: 1, Max: 86400 })
+
+	// the settings read at startup, from a file giving the source & policy
+	static := map[string]string{}
+	for _, name := range staticFlags {
+		static[name] = flag.Lookup(name).DefValue
+	}
+	static["source"] = "ingress"
+	static["policy"] = "upsert-only"
+	started := "apiVersion: private-dns/v1\nsource: ingress\npolicy: upsert-only\n"
+
+	tests := []struct {
+		name     string
+		data     string
+		explicit map[string]bool
+		// flags are the values given on the command line, with explicit
+		flags    map[string]string
+		wantErr  string
+		domain   string
+		managed  bool
+	}{
+		{ name: "unchanged", data: started, domain: "app.other.internal", managed: true },
+		{
+			name: "filters change without a restart",
+			data: started + "filters:\n  domains: [corp.internal]\n",
+			domain: "app.other.internal", managed: false,
+		},
+		{ name: "static setting changed", data: "apiVersion: private-dns/v1\nsource: ingress\npolicy: sync\n", wantErr: `changing policy from "upsert-only" to "sync" needs a restart` },
+		{ name: "static setting removed", data: "apiVersion: private-dns/v1\npolicy: upsert-only\n", wantErr: `changing source from "ingress" to "" needs a restart` },
+		{ name: "static setting added", data: started + "ownerId: cluster-b\n", wantErr: "changing owner-id" },
+		{
+			name: "command line wins over the file",
+			data: "apiVersion: private-dns/v1\nsource: service\npolicy: upsert-only\nfilters:\n  domains: [corp.internal]\n",
+			explicit: map[string]bool{ "source": true, "domain-filter": true },
+			flags: map[string]string{ "source": "ingress" },
+			domain: "app.other.internal", managed: true,
+		},
+		{ name: "invalid dynamic setting", data: started + "ttl:\n  min: 600\n  max: 60\n", wantErr: "-default-ttl must be within" },
+		{ name: "invalid regex", data: started + "filters:\n  regexDomainFilter: \"(\"\n", wantErr: "cannot parse -regex-domain-filter" },
+		{ name: "invalid file", data: "apiVersion: private-dns/v2\n", wantErr: "apiVersion must be" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider.SetFilters(provider.DomainFilter{}, provider.ZoneFilter{})
+			for name, value := range tt.flags {
+				flag.Set(name, value)
+				defer flag.Set(name, flag.Lookup(name).DefValue)
+			}
+			w := &configWatcher{ explicit: tt.explicit, static: static }
+			if w.explicit == nil {
+				w.explicit = map[string]bool{}
+			}
+			err := w.reload([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("reload error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			if got := provider.MatchDomain(tt.domain); got != tt.managed {
+				t.Errorf("after reload MatchDomain(%q) = %v, want %v", tt.domain, got, tt.managed)
+			}
+		})
+	}
+}
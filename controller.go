@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"golang.org/x/time/rate"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 
 	"private-dns/handler"
+	"private-dns/plan"
+	"private-dns/provider"
 )
 
 // Controller struct defines how a controller should encapsulate
@@ -26,33 +38,87 @@ type Controller struct {
 	// time, and makes it easy to ensure we are never processing the same item
 	// simultaneously in two different workers.
 	workqueue     workqueue.RateLimitingInterface
-	informer  cache.SharedIndexInformer
+	informers  []cache.SharedIndexInformer
 	dnshandler   handler.Handler
+	// published is the records last applied for each key, the changes for a key are worked out against it
+	published    *handler.Published
+	// dynamicClient patches the finalizer & status annotation of the watched objects, whatever their kind
+	dynamicClient dynamic.Interface
+	// finalizer adds the handler.Finalizer to the objects publishing records
+	finalizer bool
+	// recorder emits Events on the objects whose records change, nil to disable
+	recorder record.EventRecorder
+	// writeStatus writes the handler.StatusAnnotation to the objects whose records change
+	writeStatus bool
+	// zones are the zone & record name of each fqdn, from the last successful change to its record
+	zonesMu sync.Mutex
+	zones   map[string]provider.Result
+	// warned is the template failure last reported for each key, so an unchanged failure isn't reported again
+	warnedMu sync.Mutex
+	warned   map[string]string
+
+	// health of the workers & Azure, see Healthy & Ready
+	health controllerHealth
+
+	// reconcileInterval is the period of the full reconciliation, run under the policies, 0 disables it
+	reconcileInterval time.Duration
+	policies          []plan.Policy
+
+	// gracePeriod is how long the keys being processed have to finish once the controller is stopped,
+	// the workCtx their changes are made under is cancelled after it
+	gracePeriod time.Duration
+	workCtx     context.Context
+	cancelWork  context.CancelFunc
+
+	// maxRetries is how many times a failed key is retried before it is parked in the deadLetters
+	maxRetries int
+	// deadLetters are re-attempted about every deadLetterInterval, with jitter
+	deadLetters        *deadLetters
+	deadLetterInterval time.Duration
 }
 
-
-type queueItem struct {
-	key interface{}
-	changes handler.HashableDNSChanges
+// retryConfig is how a failed key is retried, with a delay doubling from baseDelay up to maxDelay, maxRetries
+// times, the keys still failing after that are parked & re-attempted every deadLetterInterval
+type retryConfig struct {
+	maxRetries         int
+	baseDelay          time.Duration
+	maxDelay           time.Duration
+	deadLetterInterval time.Duration
 }
 
-// NewController returns a new sample controller
+// errNotDrained is returned by Run when keys were still being processed at the end of the grace period
+var errNotDrained = errors.New("the workers did not finish within the shutdown grace period")
+
+// NewController returns a new sample controller, the events of every informer are passed to the dnshandler
 func NewController(
 	client kubernetes.Interface,
-	serviceInformer cache.SharedIndexInformer,
-	dnshandler handler.Handler) *Controller {
+	dynamicClient dynamic.Interface,
+	dnshandler handler.Handler,
+	retry retryConfig,
+	informers ...cache.SharedIndexInformer) *Controller {
 
 	// The SharedInformer can't track where each controller is up to (because it's shared), so the controller must provide its own queuing
 	// and retrying mechanism (if required). Hence, most Resource Event Handlers simply place items onto a per-consumer workqueue.
 	// Workqueue is provided in the client-go library at client-go/util/workqueue.
-	// A key uses the format <resource_namespace>/<resource_name>
+	// A key names an object whose records may change, the dnshandler works out the keys each event touches.
+	// The records are only worked out when the key is processed, from the latest cached state, so events for
+	// the same object can't be applied out of order & a burst of events collapses into a single change
 
 	controller := &Controller{
 		clientset: client,
-		informer:  serviceInformer,
-		workqueue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		dynamicClient: dynamicClient,
+		informers:  informers,
+		workqueue:     workqueue.NewNamedRateLimitingQueue(newRateLimiter(retry), "dns"),
 		dnshandler:   dnshandler,
+		published:    handler.NewPublished(),
+		zones:        map[string]provider.Result{},
+		warned:       map[string]string{},
+		gracePeriod:  30 * time.Second,
+		maxRetries:   retry.maxRetries,
+		deadLetters:  newDeadLetters(),
+		deadLetterInterval: retry.deadLetterInterval,
 	}
+	controller.workCtx, controller.cancelWork = context.WithCancel(context.Background())
 
 
 
@@ -61,90 +127,187 @@ func NewController(
 	//  - adding new resources
 	//  - updating existing resources
 	//  - deleting resources
-	serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-
-			key, err := cache.MetaNamespaceKeyFunc(obj)
-			if err != nil {
-				utilruntime.HandleError(err)
-				return
-			}
-			klog.Infof("Updated: %s", key)
-
-			controller.workqueue.Add(queueItem{
-				key: key,
-				changes: controller.dnshandler.ObjectCreated (obj),
-			})
-		},
-		UpdateFunc: func(old, new interface{}) {
-
-			key, err := cache.MetaNamespaceKeyFunc(new)
-			if err != nil {
-				utilruntime.HandleError(err)
-				return
-			}
-			klog.Infof("Updated: %s", key)
-
-			controller.workqueue.Add(queueItem{
-				key: key,
-				changes: controller.dnshandler.ObjectUpdated (old, new),
-			})
-		},
-		DeleteFunc: func(obj interface{}) {
-			key, err := cache.MetaNamespaceKeyFunc(obj)
-			if err != nil {
-				utilruntime.HandleError(err)
-				return
-			}
-			klog.Infof("Delete: %s", key)
-
-			controller.workqueue.Add(queueItem{
-				key: key,
-				changes: controller.dnshandler.ObjectDeleted (obj),
-			})
-		},
-	})
+	for _, informer := range informers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				controller.enqueue("Add", controller.dnshandler.Keys(obj))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				// the old object's keys too, so records it published are removed if the new one no longer does
+				controller.enqueue("Update", append(controller.dnshandler.Keys(old), controller.dnshandler.Keys(new)...))
+			},
+			DeleteFunc: func(obj interface{}) {
+				// a delete missed while the watch was down arrives as a tombstone holding the last known object
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				controller.enqueue("Delete", controller.dnshandler.Keys(obj))
+			},
+		})
+	}
 
 	return controller
 
 }
 
+// enqueue adds each key touched by an event, the workqueue drops keys already waiting to be processed
+func (c *Controller) enqueue(event string, keys []string) {
+	for _, key := range keys {
+		klog.Infof("%s: %s", event, key)
+		c.workqueue.Add(key)
+	}
+}
+
+// UseFinalizer adds the handler.Finalizer to every object publishing records, so an object deleted while the
+// controller is down waits for its records to be removed, the finalizer is removed from an object being deleted
+// whether or not it is used
+func (c *Controller) UseFinalizer() {
+	c.finalizer = true
+}
+
+// RecordEvents emits Normal & Warning Events on the objects whose records are changed, skipped or fail
+func (c *Controller) RecordEvents(recorder record.EventRecorder) {
+	c.recorder = recorder
+}
+
+// WriteStatus writes the handler.StatusAnnotation to the objects whose records change, for kubectl describe
+func (c *Controller) WriteStatus() {
+	c.writeStatus = true
+}
+
+// ReconcileEvery enables a full reconciliation of every cached object against the DNS zones each interval,
+// this corrects drift, missed events and manual edits the event driven changes cannot see
+func (c *Controller) ReconcileEvery(interval time.Duration, policies []plan.Policy) {
+	c.reconcileInterval = interval
+	c.policies = policies
+}
+
+// DrainWithin sets how long the keys being processed have to finish once the controller is stopped
+func (c *Controller) DrainWithin(gracePeriod time.Duration) {
+	c.gracePeriod = gracePeriod
+}
+
+// newRateLimiter returns the overall rate limit of workqueue.DefaultControllerRateLimiter, with the per key backoff of retry
+func newRateLimiter(retry retryConfig) workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(retry.baseDelay, retry.maxDelay),
+		&workqueue.BucketRateLimiter{ Limiter: rate.NewLimiter(rate.Limit(10), 100) },
+	)
+}
+
 // Run is the main path of execution for the controller loop
 func (c *Controller) Run(threadiness int,  stopCh <-chan struct{}) error {
 	// handle a panic with logging and exiting
 	defer utilruntime.HandleCrash()
-	// ignore new items in the queue but when all goroutines
-	// have completed existing items then shutdown
-	defer c.workqueue.ShutDown()
 
 	klog.Info("Controller.Run: initiating")
 
-	// run the informer to start listing and watching resources
-	go c.informer.Run(stopCh)
+	if err := c.Start(stopCh); err != nil {
+		return err
+	}
+	return c.RunWorkers(threadiness, stopCh)
+}
+
+// Start runs the informers and waits for their caches to sync, a replica that is not the leader
+// only runs this, so its caches & workqueue are warm if it takes over
+func (c *Controller) Start(stopCh <-chan struct{}) error {
+	// run the informers to start listing and watching resources
+	for _, informer := range c.informers {
+		go informer.Run(stopCh)
+	}
+
+	if c.health.pingInterval > 0 {
+		go wait.Until(c.ping, c.health.pingInterval, stopCh)
+	}
 
 	// do the initial synchronization (one time) to populate resources
 	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
+	return nil
+}
+
+// RunWorkers processes the workqueue, and runs the reconciliation, until stopCh is closed, then drains the
+// workers, errNotDrained is returned if they did not finish within the grace period
+func (c *Controller) RunWorkers(threadiness int, stopCh <-chan struct{}) error {
+	c.health.setRunning(true)
+	defer c.health.setRunning(false)
 
 	klog.Info("Controller.Run: Starting workers")
 
-	// run the runWorker method every second with a stop channel
+	// run the runWorker method every second with a stop channel, wait.Until returns once the current run finishes
+	var workers sync.WaitGroup
 	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.runWorker, time.Second, stopCh)
+		}()
+	}
+
+	if c.deadLetterInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.retryDeadLetters, deadLetterCheckPeriod, stopCh)
+		}()
+	}
+
+	if c.reconcileInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.reconcile, c.reconcileInterval, stopCh)
+		}()
 	}
 
 	klog.Info("Started workers")
 	<-stopCh
 	klog.Info("Shutting down workers")
+	return c.drain(&workers)
+}
 
-	return nil
+// drain stops the workers taking keys, and waits up to the grace period for the keys being processed to finish,
+// then cancels the changes they are making
+func (c *Controller) drain(workers *sync.WaitGroup) error {
+	// ignore new items in the queue, and wake the workers waiting on it
+	c.workqueue.ShutDown()
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		klog.Info("Controller.drain: workers finished")
+		return nil
+	case <-time.After(c.gracePeriod):
+		klog.Errorf("Controller.drain: workers still busy after %v, cancelling their changes", c.gracePeriod)
+		c.cancelWork()
+		return errNotDrained
+	}
+}
+
+// reconcile runs one full reconciliation, errors are retried at the next interval
+func (c *Controller) reconcile() {
+	klog.Info("Controller.reconcile: start")
+	if err := c.dnshandler.Reconcile(c.workCtx, c.policies); err != nil {
+		klog.Errorf("Error reconciling (will retry in %v): %v", c.reconcileInterval, err)
+		utilruntime.HandleError(err)
+	}
 }
 
 // HasSynced allows us to satisfy the Controller interface
-// by wiring up the informer's HasSynced method to it
+// by wiring up the informers' HasSynced methods to it
 func (c *Controller) HasSynced() bool {
-	return c.informer.HasSynced()
+	for _, informer := range c.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
 }
 
 // runWorker executes the loop to process new items added to the queue
@@ -170,6 +333,8 @@ func (c *Controller) processNextWorkItem() bool {
 	// if a shutdown is requested then return out of this to stop
 	// processing
 	event, quit := c.workqueue.Get()
+	c.health.started()
+	defer c.health.finished()
 
 	// stop the worker loop from running as this indicates we
 	// have sent a shutdown message that the queue has indicated
@@ -177,26 +342,133 @@ func (c *Controller) processNextWorkItem() bool {
 	if quit {
 		return false
 	}
+	// the controller is stopping, leave the key for the next start's full listing
+	if c.workqueue.ShuttingDown() {
+		c.workqueue.Done(event)
+		return false
+	}
 
 	defer c.workqueue.Done(event)
 
-	queueItem := event.(queueItem)
-	err := c.dnshandler.ApplyChanges(queueItem.changes)
+	key := event.(string)
+	// a dead letter queued by retryDeadLetters gets a single re-attempt, queued by an event on its object it is
+	// retried -max-retries times again, its ratelimit counters were reset when it was parked
+	reattempt := c.deadLetters.queued(key)
+	err := c.syncKey(key)
 
 	if err == nil {
 		// No error, reset the ratelimit counters
 		c.workqueue.Forget(event)
-	} else if c.workqueue.NumRequeues(event) < 5 {
-		klog.Errorf("Error processing %s (will retry): %v", queueItem.key, err)
-		c.workqueue.AddRateLimited(queueItem)
+		c.recovered(key)
+	} else if reattempt {
+		// a failed re-attempt, the key waits for the next one
+		c.workqueue.Forget(event)
+		c.deadLetter(key, err, 1)
+	} else if c.workqueue.NumRequeues(event) < c.maxRetries {
+		if provider.IsTimeout(err) {
+			klog.Errorf("Timeout processing %s (will retry): %v", key, err)
+		} else {
+			klog.Errorf("Error processing %s (will retry): %v", key, err)
+		}
+		c.workqueue.AddRateLimited(event)
 	} else {
-		// err != nil and too many retries
-		klog.Errorf("Error processing %s (giving up): %v", queueItem.key, err)
-		c.workqueue.Forget(queueItem)
+		// err != nil and too many retries, park the key to re-attempt it slowly
+		klog.Errorf("Error processing %s (giving up, will re-attempt in about %v): %v", key, c.deadLetterInterval, err)
+		attempts := c.workqueue.NumRequeues(event) + 1
+		c.workqueue.Forget(event)
+		c.deadLetter(key, err, attempts)
 		utilruntime.HandleError(err)
 	}
 
-
 	// keep the worker loop running by returning true
 	return true
 }
+
+// syncKey applies the changes between the records last published for key & the records it should publish now,
+// the published records are only updated once every change is applied, so a failed key is retried in full
+func (c *Controller) syncKey(key string) error {
+	desired, err := c.dnshandler.Desired(key)
+	// a template failure is reported on the object rather than retried, the records it still publishes are synced
+	templateErr, _ := err.(*handler.TemplateError)
+	if templateErr != nil {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	warning := c.newWarning(key, templateErr)
+
+	obj, gvr := c.dnshandler.Object(key)
+	if obj != nil && obj.GetDeletionTimestamp() != nil {
+		// the object is waiting on its finalizers, delete its records, including those published before a restart
+		c.published.Seed(key, desired)
+		desired = nil
+	}
+
+	ctx, results := provider.WithResults(c.workCtx)
+	for _, changes := range c.published.Changes(key, desired) {
+		if err = c.dnshandler.ApplyChanges(ctx, changes); err != nil {
+			break
+		}
+	}
+	var finalizerErr error
+	if err == nil {
+		c.published.Set(key, desired)
+		// the finalizer patch carries the cached resourceVersion, so it goes before the status annotation changes it
+		finalizerErr = c.updateFinalizer(obj, gvr, desired)
+	}
+	c.report(key, obj, gvr, desired, results.List(), warning, err)
+	if err != nil {
+		return err
+	}
+	return finalizerErr
+}
+
+// updateFinalizer adds the handler.Finalizer to an object publishing records with -finalizer, & removes it once
+// the object has no records, or is being deleted
+func (c *Controller) updateFinalizer(obj meta_v1.Object, gvr schema.GroupVersionResource, desired []handler.DNSEntry) error {
+	if obj == nil {
+		return nil
+	}
+	if obj.GetDeletionTimestamp() != nil {
+		// the records are gone, release the object even without -finalizer, it may carry the finalizer from an earlier run
+		return c.setFinalizer(obj, gvr, false)
+	}
+	if c.finalizer {
+		return c.setFinalizer(obj, gvr, len(desired) > 0)
+	}
+	return nil
+}
+
+// setFinalizer adds or removes the handler.Finalizer, the resourceVersion in the patch fails it if the object changed
+func (c *Controller) setFinalizer(obj meta_v1.Object, gvr schema.GroupVersionResource, present bool) error {
+	finalizers := []string{}
+	found := false
+	for _, f := range obj.GetFinalizers() {
+		if f == handler.Finalizer {
+			found = true
+			continue
+		}
+		finalizers = append(finalizers, f)
+	}
+	if found == present {
+		return nil
+	}
+	if present {
+		finalizers = append(finalizers, handler.Finalizer)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": obj.GetResourceVersion(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Controller.setFinalizer: %s %s/%s finalizer=%v", gvr.Resource, obj.GetNamespace(), obj.GetName(), present)
+	_, err = c.dynamicClient.Resource(gvr).Namespace(obj.GetNamespace()).Patch(obj.GetName(), types.MergePatchType, patch, meta_v1.PatchOptions{})
+	return err
+}
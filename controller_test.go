@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/workqueue"
+
+	"private-dns/handler"
+	"private-dns/plan"
+	"private-dns/provider"
+)
+
+// fakeHandler publishes the desired records of each key, & records the changes applied, failing them with fail
+type fakeHandler struct {
+	desired map[string][]handler.DNSEntry
+	applied []string
+	fail    error
+}
+
+func (h *fakeHandler) ApplyChanges(ctx context.Context, changes handler.HashableDNSChanges) error {
+	if h.fail != nil {
+		return h.fail
+	}
+	apply, ok := handler.HashDNSToPlan(changes)
+	if !ok {
+		return nil
+	}
+	for _, e := range apply.Create {
+		h.applied = append(h.applied, "create "+e.DNSName)
+	}
+	for _, e := range apply.UpdateNew {
+		h.applied = append(h.applied, "update "+e.DNSName)
+	}
+	for _, e := range apply.Delete {
+		h.applied = append(h.applied, "delete "+e.DNSName)
+	}
+	return nil
+}
+
+func (h *fakeHandler) Keys(obj interface{}) []string { return nil }
+
+func (h *fakeHandler) Desired(key string) ([]handler.DNSEntry, error) { return h.desired[key], nil }
+
+func (h *fakeHandler) Object(key string) (meta_v1.Object, schema.GroupVersionResource) {
+	return nil, schema.GroupVersionResource{}
+}
+
+func (h *fakeHandler) Ping(ctx context.Context) error { return nil }
+
+func (h *fakeHandler) Plan(ctx context.Context, policies []plan.Policy) (*plan.Changes, error) {
+	return &plan.Changes{}, nil
+}
+
+func (h *fakeHandler) Reconcile(ctx context.Context, policies []plan.Policy) error { return nil }
+
+func (h *fakeHandler) Apply(ctx context.Context, changes *plan.Changes) error { return nil }
+
+// newTestController returns a Controller over the handler, without a cluster, Events or status annotations
+func newTestController(h handler.Handler, maxRetries int) *Controller {
+	c := &Controller{
+		workqueue:   workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond)),
+		dnshandler:  h,
+		published:   handler.NewPublished(),
+		zones:       map[string]provider.Result{},
+		warned:      map[string]string{},
+		maxRetries:  maxRetries,
+		deadLetters: newDeadLetters(),
+		deadLetterInterval: time.Hour,
+	}
+	c.workCtx, c.cancelWork = context.WithCancel(context.Background())
+	return c
+}
+
+func TestSyncKey(t *testing.T) {
+	shared := handler.NewDNSEntry("shared.corp.internal", "A", 300, "10.0.0.1")
+	app := handler.NewDNSEntry("app.corp.internal", "A", 300, "10.0.0.1")
+	api := handler.NewDNSEntry("api.corp.internal", "A", 300, "10.0.0.2")
+
+	h := &fakeHandler{ desired: map[string][]handler.DNSEntry{
+		"default/app": { shared, app },
+		"default/api": { shared, api },
+	} }
+	c := newTestController(h, 3)
+
+	steps := []struct {
+		name    string
+		key     string
+		desired []handler.DNSEntry
+		fail    error
+		want    []string
+	}{
+		{ name: "first sync creates every record", key: "default/app", desired: []handler.DNSEntry{ shared, app }, want: []string{ "create shared.corp.internal", "create app.corp.internal" } },
+		{ name: "a second key with a shared name", key: "default/api", desired: []handler.DNSEntry{ shared, api }, want: []string{ "create shared.corp.internal", "create api.corp.internal" } },
+		{ name: "unchanged", key: "default/app", desired: []handler.DNSEntry{ shared, app }, want: []string{} },
+		{ name: "one name removed", key: "default/app", desired: []handler.DNSEntry{ shared }, want: []string{ "delete app.corp.internal" } },
+		{ name: "a failed change is not recorded as published", key: "default/app", desired: []handler.DNSEntry{ shared, app }, fail: errors.New("azure down"), want: []string{} },
+		{ name: "so it is retried in full", key: "default/app", desired: []handler.DNSEntry{ shared, app }, want: []string{ "create app.corp.internal" } },
+		{ name: "deleted object sharing a name keeps the shared record", key: "default/app", want: []string{ "delete app.corp.internal" } },
+		{ name: "the last object with the name deletes it", key: "default/api", want: []string{ "delete shared.corp.internal", "delete api.corp.internal" } },
+	}
+	for _, s := range steps {
+		h.desired[s.key] = s.desired
+		h.fail = s.fail
+		h.applied = []string{}
+		err := c.syncKey(s.key)
+		if (err != nil) != (s.fail != nil) {
+			t.Fatalf("%s: syncKey(%s) error = %v, want %v", s.name, s.key, err, s.fail)
+		}
+		if !reflect.DeepEqual(h.applied, s.want) {
+			t.Errorf("%s: syncKey(%s) applied %v, want %v", s.name, s.key, h.applied, s.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"private-dns/metrics"
+)
+
+// deadLetterCheckPeriod is how often the dead letters are checked for a re-attempt that is due
+const deadLetterCheckPeriod = 10 * time.Second
+
+// deadLetterJitter spreads the re-attempts up to half an interval later, so keys parked together are not re-attempted together
+const deadLetterJitter = 0.5
+
+// deadLetter is a key that failed every retry, it is re-attempted once each interval until it succeeds
+type deadLetter struct {
+	Key string `json:"key"`
+	// Error is the error of the last attempt
+	Error string `json:"error"`
+	// Attempts counts the failed attempts, the retries & the re-attempts
+	Attempts int `json:"attempts"`
+	Since time.Time `json:"since"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	// queued is true while the re-attempt is in the workqueue
+	queued bool
+}
+
+// deadLetters are the keys that failed every retry, they are only kept in memory, the full listing at the
+// next start processes every key again
+type deadLetters struct {
+	mu    sync.Mutex
+	items map[string]*deadLetter
+}
+
+func newDeadLetters() *deadLetters {
+	return &deadLetters{ items: map[string]*deadLetter{} }
+}
+
+// park adds key, or updates it after a failed re-attempt, it returns true the first time key is parked
+func (d *deadLetters) park(key string, err error, attempts int, interval time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	item, ok := d.items[key]
+	if !ok {
+		item = &deadLetter{ Key: key, Since: now }
+		d.items[key] = item
+	}
+	item.Error = err.Error()
+	item.Attempts += attempts
+	item.LastAttempt = now
+	item.NextAttempt = now.Add(wait.Jitter(interval, deadLetterJitter))
+	item.queued = false
+	metrics.SetDeadLetters(len(d.items))
+	return !ok
+}
+
+// queued returns true if key is a dead letter queued by retryDeadLetters, rather than by an event on its object
+func (d *deadLetters) queued(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	item, ok := d.items[key]
+	return ok && item.queued
+}
+
+// remove drops key once it succeeds, it returns the dead letter, nil if key was not parked
+func (d *deadLetters) remove(key string) *deadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	item, ok := d.items[key]
+	if !ok {
+		return nil
+	}
+	delete(d.items, key)
+	metrics.SetDeadLetters(len(d.items))
+	return item
+}
+
+// due returns the keys whose re-attempt is due, & marks them queued
+func (d *deadLetters) due() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	keys := []string{}
+	for key, item := range d.items {
+		if !item.queued && !now.Before(item.NextAttempt) {
+			item.queued = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// list returns a copy of the dead letters, ordered by key
+func (d *deadLetters) list() []deadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	items := make([]deadLetter, 0, len(d.items))
+	for _, item := range d.items {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items
+}
+
+// deadLetter parks key after its last retry failed with err, a Warning Event is emitted the first time
+func (c *Controller) deadLetter(key string, err error, attempts int) {
+	first := c.deadLetters.park(key, err, attempts, c.deadLetterInterval)
+	metrics.DeadLettered(first)
+	if !first {
+		klog.Errorf("Error re-attempting dead letter %s (will re-attempt in about %v): %v", key, c.deadLetterInterval, err)
+		return
+	}
+	obj, _ := c.dnshandler.Object(key)
+	c.event(obj, core_v1.EventTypeWarning, "DeadLettered", "Gave up on %s after %d attempts, re-attempting about every %v: %v", key, attempts, c.deadLetterInterval, err)
+}
+
+// recovered drops key from the dead letters after it succeeded
+func (c *Controller) recovered(key string) {
+	item := c.deadLetters.remove(key)
+	if item == nil {
+		return
+	}
+	metrics.DeadLetterRecovered()
+	obj, _ := c.dnshandler.Object(key)
+	c.event(obj, core_v1.EventTypeNormal, "Recovered", "Synced %s after %d failed attempts since %s", key, item.Attempts, item.Since.UTC().Format(time.RFC3339))
+}
+
+// retryDeadLetters queues the dead letters whose re-attempt is due
+func (c *Controller) retryDeadLetters() {
+	for _, key := range c.deadLetters.due() {
+		klog.Infof("Re-attempting dead letter %s", key)
+		c.workqueue.Add(key)
+	}
+}
+
+// deadLettersHandler serves the dead letters as JSON, for /debug/dead-letters
+func (c *Controller) deadLettersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(c.deadLetters.list()); err != nil {
+			klog.Errorf("Error writing the dead letters: %v", err)
+		}
+	})
+}
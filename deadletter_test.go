@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"private-dns/handler"
+)
+
+func TestDeadLetters(t *testing.T) {
+	d := newDeadLetters()
+	interval := time.Minute
+
+	before := time.Now()
+	if first := d.park("default/app", errors.New("azure down"), 6, interval); !first {
+		t.Errorf("park(default/app) = false, want true the first time")
+	}
+	item := d.list()[0]
+	since := item.Since
+	if item.Attempts != 6 || item.Error != "azure down" {
+		t.Errorf("parked %+v, want 6 attempts & the error", item)
+	}
+	if wait := item.NextAttempt.Sub(before); wait < interval || wait > interval*3/2+time.Second {
+		t.Errorf("next attempt in %v, want an interval of %v plus up to half of it", wait, interval)
+	}
+	if got := d.due(); len(got) != 0 {
+		t.Errorf("due = %v before the next attempt, want none", got)
+	}
+
+	d.items["default/app"].NextAttempt = time.Now()
+	if got, want := d.due(), []string{ "default/app" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("due = %v, want %v", got, want)
+	}
+	if !d.queued("default/app") {
+		t.Errorf("queued(default/app) = false once due, want true")
+	}
+	if got := d.due(); len(got) != 0 {
+		t.Errorf("due = %v while the re-attempt is queued, want none", got)
+	}
+
+	if first := d.park("default/app", errors.New("still down"), 1, interval); first {
+		t.Errorf("park(default/app) = true after a re-attempt, want false")
+	}
+	item = d.list()[0]
+	if item.Attempts != 7 || item.Error != "still down" || d.queued("default/app") {
+		t.Errorf("after a failed re-attempt %+v, want 7 attempts, the last error & not queued", item)
+	}
+	if !item.Since.Equal(since) || item.LastAttempt.Before(since) {
+		t.Errorf("after a failed re-attempt since %v & last attempt %v, want the first park kept", item.Since, item.LastAttempt)
+	}
+
+	if removed := d.remove("default/app"); removed == nil || removed.Attempts != 7 {
+		t.Errorf("remove(default/app) = %+v, want the dead letter", removed)
+	}
+	if removed := d.remove("default/app"); removed != nil {
+		t.Errorf("remove(default/app) = %+v a second time, want nil", removed)
+	}
+	if d.queued("default/app") || len(d.list()) != 0 {
+		t.Errorf("dead letters %v after remove, want none", d.list())
+	}
+}
+
+// processUntilParked processes key until it is parked, failing the test if it takes more than the retries
+func processUntilParked(t *testing.T, c *Controller, key string) {
+	for i := 0; i <= c.maxRetries; i++ {
+		c.processNextWorkItem()
+		if len(c.deadLetters.list()) > 0 {
+			return
+		}
+	}
+	t.Fatalf("%s not parked after %d attempts", key, c.maxRetries+1)
+}
+
+func TestProcessDeadLetter(t *testing.T) {
+	key := "default/app"
+	h := &fakeHandler{
+		desired: map[string][]handler.DNSEntry{ key: { handler.NewDNSEntry("app.corp.internal", "A", 300, "10.0.0.1") } },
+		fail:    errors.New("azure down"),
+	}
+	c := newTestController(h, 2)
+	defer c.workqueue.ShutDown()
+
+	c.workqueue.Add(key)
+	processUntilParked(t, c, key)
+	if got := c.deadLetters.list()[0].Attempts; got != 3 {
+		t.Errorf("parked after %d attempts, want 3", got)
+	}
+	if n := c.workqueue.NumRequeues(key); n != 0 {
+		t.Errorf("NumRequeues = %d once parked, want 0", n)
+	}
+
+	// a re-attempt queued by the timer is tried once & parked again
+	c.deadLetters.items[key].NextAttempt = time.Now()
+	c.retryDeadLetters()
+	c.processNextWorkItem()
+	if got := c.deadLetters.list()[0].Attempts; got != 4 {
+		t.Errorf("after a re-attempt, %d attempts, want 4", got)
+	}
+	if n := c.workqueue.NumRequeues(key); n != 0 {
+		t.Errorf("NumRequeues = %d after a re-attempt, want 0, it waits for the next one", n)
+	}
+
+	// queued by an event, the key is retried -max-retries times again before it is parked again
+	c.workqueue.Add(key)
+	c.processNextWorkItem()
+	if n := c.workqueue.NumRequeues(key); n != 1 {
+		t.Errorf("NumRequeues = %d after an event, want 1, a rate limited retry", n)
+	}
+	c.processNextWorkItem()
+	c.processNextWorkItem()
+	if got := c.deadLetters.list()[0].Attempts; got != 7 {
+		t.Errorf("after the retries of an event, %d attempts, want 7", got)
+	}
+	if n := c.workqueue.NumRequeues(key); n != 0 {
+		t.Errorf("NumRequeues = %d once parked again, want 0", n)
+	}
+
+	// the key recovers on its next successful sync
+	h.fail = nil
+	c.workqueue.Add(key)
+	c.processNextWorkItem()
+	if got := c.deadLetters.list(); len(got) != 0 {
+		t.Errorf("dead letters %v after a successful sync, want none", got)
+	}
+	if got, want := h.applied, []string{ "create app.corp.internal" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied %v, want %v", got, want)
+	}
+}
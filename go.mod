@@ -7,8 +7,16 @@ require (
 	github.com/Azure/go-autorest/autorest v0.9.2
 	github.com/Azure/go-autorest/autorest/azure/auth v0.4.0
 	github.com/Azure/go-autorest/autorest/to v0.3.0
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/evanphx/json-patch v4.5.0+incompatible // indirect
+	github.com/golang/groupcache v0.0.0-20191002201903-404acd9df4cc // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_golang v0.9.2
+	github.com/prometheus/client_model v0.2.0 // indirect
+	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c
 	k8s.io/api v0.0.0-20191010143144-fbf594f18f80
 	k8s.io/apimachinery v0.0.0-20191006235458-f9f2f3f8ab02
 	k8s.io/client-go v0.0.0-20191010200049-172b42569cca
 	k8s.io/klog/v2 v2.0.0-20190919174302-ab80cd2723c2
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"k8s.io/klog/v2"
+)
+
+// DefaultAnnotationPrefix starts the name of every annotation, and the finalizer, unless SetAnnotationPrefix changes it
+const DefaultAnnotationPrefix = "service.beta.kubernetes.io/azure-dns"
+
+// the annotation names are only changed by SetAnnotationPrefix, before the controller starts
+var (
+	// FQDNAnnotation names the records published for a Service, a comma separated list that may include wildcards
+	FQDNAnnotation = DefaultAnnotationPrefix + "-zone-fqdn"
+	// TargetAnnotation overrides the published targets with a comma separated list of IPs, or a single hostname published as a CNAME
+	TargetAnnotation = DefaultAnnotationPrefix + "-target"
+	// TTLAnnotation overrides the TTL, in seconds, of the records published for an object
+	TTLAnnotation = DefaultAnnotationPrefix + "-ttl"
+	// StatusAnnotation is written back to an object with the zone, name & targets of its records & the last sync result
+	StatusAnnotation = DefaultAnnotationPrefix + "-status"
+	// Finalizer holds a watched object, with -finalizer, until the records it published are deleted
+	Finalizer = DefaultAnnotationPrefix + "-cleanup"
+)
+
+// SetAnnotationPrefix renames every annotation & the finalizer to start with prefix, eg 'example.com/dns'
+func SetAnnotationPrefix(prefix string) {
+	FQDNAnnotation = prefix + "-zone-fqdn"
+	TargetAnnotation = prefix + "-target"
+	TTLAnnotation = prefix + "-ttl"
+	StatusAnnotation = prefix + "-status"
+	Finalizer = prefix + "-cleanup"
+}
+
+// TTLSettings hold the TTL given to records without a TTLAnnotation, and the bounds an annotated TTL must be within
+type TTLSettings struct {
+	Default int
+	Min     int
+	Max     int
+}
+
+var (
+	ttlMu       sync.RWMutex
+	ttlSettings = TTLSettings{Default: 3600, Min: 1, Max: 86400}
+)
+
+// SetTTLSettings replaces the TTL default & bounds used by every handler
+func SetTTLSettings(s TTLSettings) {
+	ttlMu.Lock()
+	defer ttlMu.Unlock()
+	ttlSettings = s
+}
+
+// fqdnList returns the names in a comma separated FQDNAnnotation value
+func fqdnList(value string) []string {
+	fqdns := []string{}
+	for _, f := range strings.Split(value, ",") {
+		if f = strings.TrimSuffix(strings.TrimSpace(f), "."); f != "" {
+			fqdns = append(fqdns, f)
+		}
+	}
+	return dedupe(fqdns)
+}
+
+// NewFQDNTemplate parses a text/template naming the records of objects without an explicit hostname,
+// it is executed against the object, eg '{{.Name}}.{{.Namespace}}.aks.corp.internal'. Empty returns nil
+func NewFQDNTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("fqdn").Option("missingkey=error").Parse(text)
+}
+
+// TemplateError is returned by Desired, with the records the object still publishes, when the fqdn template
+// fails for the object, a problem of the object to report rather than a failed sync to retry
+type TemplateError struct {
+	Object string
+	Err    error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("failed to execute the fqdn template for %s: %v", e.Object, e.Err)
+}
+
+// templateFQDNs returns the names produced by executing tmpl against obj, a *TemplateError if it fails
+func templateFQDNs(tmpl *template.Template, obj interface{}, object string) ([]string, error) {
+	if tmpl == nil {
+		return nil, nil
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, obj); err != nil {
+		klog.Errorf("Failed to execute fqdn template for %s: %v", object, err)
+		return nil, &TemplateError{ Object: object, Err: err }
+	}
+	return fqdnList(out.String()), nil
+}
+
+// targetOverride returns the targets from a TargetAnnotation, false if the object has no valid override
+func targetOverride(annotations map[string]string, object string) ([]string, bool) {
+	value, ok := annotations[TargetAnnotation]
+	if !ok {
+		return nil, false
+	}
+	targets := fqdnList(value)
+	if len(targets) == 0 {
+		klog.Errorf("Ignoring %s annotation on %s, no targets given", TargetAnnotation, object)
+		return nil, false
+	}
+	if len(targets) > 1 {
+		for _, t := range targets {
+			if net.ParseIP(t) == nil {
+				klog.Errorf("Ignoring %s annotation on %s, '%s' must be a list of IPs or a single hostname", TargetAnnotation, object, value)
+				return nil, false
+			}
+		}
+	}
+	return targets, true
+}
+
+// recordTTL returns the TTL for the records of an object, from its TTLAnnotation if that is a valid
+// number of seconds within the configured bounds, otherwise the default
+func recordTTL(annotations map[string]string, object string) int {
+	ttlMu.RLock()
+	s := ttlSettings
+	ttlMu.RUnlock()
+
+	value, ok := annotations[TTLAnnotation]
+	if !ok {
+		return s.Default
+	}
+	ttl, err := strconv.Atoi(value)
+	if err != nil {
+		klog.Errorf("Ignoring %s annotation on %s, '%s' is not a number of seconds", TTLAnnotation, object, value)
+		return s.Default
+	}
+	if ttl < s.Min || ttl > s.Max {
+		klog.Errorf("Ignoring %s annotation on %s, %d is outside the allowed range %d-%d", TTLAnnotation, object, ttl, s.Min, s.Max)
+		return s.Default
+	}
+	return ttl
+}
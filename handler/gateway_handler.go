@@ -0,0 +1,301 @@
+package handler
+
+import (
+	"k8s.io/klog/v2"
+
+	"fmt"
+	"strings"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"private-dns/endpoint"
+	"private-dns/provider"
+)
+
+// Gateway API resources watched by the GatewayHandler
+var (
+	GatewayResource   = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}
+	HTTPRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+	GRPCRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "grpcroutes"}
+	TLSRouteResource  = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1alpha2", Resource: "tlsroutes"}
+)
+
+// GatewayRouteResources are the route resources by lowercased kind, as used in the route keys & -gateway-routes
+var GatewayRouteResources = map[string]schema.GroupVersionResource{
+	"httproute": HTTPRouteResource,
+	"grpcroute": GRPCRouteResource,
+	"tlsroute":  TLSRouteResource,
+}
+
+// GatewayHandler publishes the hostnames of Gateway API routes, resolved against the listeners of
+// their parent Gateways, with the targets taken from the Gateway's status.addresses
+type GatewayHandler struct{
+	zoneHandler
+	gateways cache.Indexer
+	routes   []cache.Indexer
+}
+
+// NewGatewayHandler returns a Handler, the informers are used to look up Gateways & the routes attached to them
+func NewGatewayHandler(publicZone bool, azureAuth provider.AzureAuth, resourceGroup string, subID string, gateways cache.SharedIndexInformer, routes ...cache.SharedIndexInformer) (*GatewayHandler, error) {
+
+	klog.Info("NewGatewayHandler - Creating Azure Provider")
+
+	p, err := newProvider(publicZone, azureAuth, resourceGroup, subID)
+	if err != nil {
+		klog.Fatalf("failed to create Azure Provider: %v", err)
+		return nil, err
+	}
+
+	h := &GatewayHandler{ gateways: gateways.GetIndexer() }
+	for _, r := range routes {
+		h.routes = append(h.routes, r.GetIndexer())
+	}
+	h.zoneHandler = newZoneHandler("GatewayHandler", p, h.publishedEndpoints)
+	return h, nil
+}
+
+// getGateway returns the cached Gateway namespace/name, nil once it is deleted or while it is being deleted
+func (t *GatewayHandler) getGateway(namespace, name string) *unstructured.Unstructured {
+	obj, exists, err := t.gateways.GetByKey(namespace + "/" + name)
+	if err != nil || !exists || terminating(obj.(*unstructured.Unstructured)) {
+		return nil
+	}
+	return obj.(*unstructured.Unstructured)
+}
+
+func isGateway(obj *unstructured.Unstructured) bool {
+	return obj.GetKind() == "Gateway"
+}
+
+// parentRefs returns the parentRefs of the route that point at a Gateway
+func parentRefs(route *unstructured.Unstructured) []map[string]interface{} {
+	refs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	gws := []map[string]interface{}{}
+	for _, r := range refs {
+		ref, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group, found, _ := unstructured.NestedString(ref, "group")
+		if found && group != GatewayResource.Group {
+			continue
+		}
+		kind, found, _ := unstructured.NestedString(ref, "kind")
+		if found && kind != "Gateway" {
+			continue
+		}
+		gws = append(gws, ref)
+	}
+	return gws
+}
+
+func parentNamespace(route *unstructured.Unstructured, ref map[string]interface{}) string {
+	if ns, found, _ := unstructured.NestedString(ref, "namespace"); found && ns != "" {
+		return ns
+	}
+	return route.GetNamespace()
+}
+
+// attachedRoutes returns the cached routes with a parentRef to the Gateway namespace/name
+func (t *GatewayHandler) attachedRoutes(namespace, name string) []*unstructured.Unstructured {
+	attached := []*unstructured.Unstructured{}
+	for _, idx := range t.routes {
+		for _, obj := range idx.List() {
+			route := obj.(*unstructured.Unstructured)
+			for _, ref := range parentRefs(route) {
+				refName, _, _ := unstructured.NestedString(ref, "name")
+				if refName == name && parentNamespace(route, ref) == namespace {
+					attached = append(attached, route)
+					break
+				}
+			}
+		}
+	}
+	return attached
+}
+
+// intersectHostname returns the hostname a route publishes through a listener, following the Gateway API matching rules
+func intersectHostname(listener, route string) (string, bool) {
+	switch {
+	case listener == "" || listener == route:
+		return route, true
+	case strings.HasPrefix(listener, "*.") && strings.HasSuffix(route, listener[1:]):
+		return route, true
+	case strings.HasPrefix(route, "*.") && strings.HasSuffix(listener, route[1:]):
+		return listener, true
+	}
+	return "", false
+}
+
+// listenerHostnames returns the hostnames the route publishes through the listeners of gw selected by ref
+func listenerHostnames(gw *unstructured.Unstructured, ref map[string]interface{}, routeHosts []string) []string {
+	sectionName, _, _ := unstructured.NestedString(ref, "sectionName")
+	port, hasPort, _ := unstructured.NestedInt64(ref, "port")
+
+	hosts := []string{}
+	listeners, _, _ := unstructured.NestedSlice(gw.Object, "spec", "listeners")
+	for _, l := range listeners {
+		listener, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _, _ := unstructured.NestedString(listener, "name"); sectionName != "" && name != sectionName {
+			continue
+		}
+		if p, _, _ := unstructured.NestedInt64(listener, "port"); hasPort && p != port {
+			continue
+		}
+		listenerHost, _, _ := unstructured.NestedString(listener, "hostname")
+		if len(routeHosts) == 0 {
+			if listenerHost != "" {
+				hosts = append(hosts, listenerHost)
+			}
+			continue
+		}
+		for _, rh := range routeHosts {
+			if h, ok := intersectHostname(listenerHost, rh); ok {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts
+}
+
+// gatewayAddresses returns the values of the Gateway's status.addresses
+func gatewayAddresses(gw *unstructured.Unstructured) []string {
+	targets := []string{}
+	addresses, _, _ := unstructured.NestedSlice(gw.Object, "status", "addresses")
+	for _, a := range addresses {
+		address, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if value, _, _ := unstructured.NestedString(address, "value"); value != "" {
+			targets = append(targets, value)
+		}
+	}
+	return targets
+}
+
+// entries returns the records a route should publish through its cached parent Gateways
+func (t *GatewayHandler) entries(route *unstructured.Unstructured) []DNSEntry {
+	routeHosts, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+
+	targets := map[string][]string{}
+	fqdns := []string{}
+	for _, ref := range parentRefs(route) {
+		name, _, _ := unstructured.NestedString(ref, "name")
+		gw := t.getGateway(parentNamespace(route, ref), name)
+		if gw == nil {
+			continue
+		}
+		addresses := gatewayAddresses(gw)
+		if len(addresses) == 0 {
+			continue
+		}
+		for _, h := range listenerHostnames(gw, ref, routeHosts) {
+			if _, ok := targets[h]; !ok {
+				fqdns = append(fqdns, h)
+			}
+			targets[h] = append(targets[h], addresses...)
+		}
+	}
+
+	ttl := recordTTL(route.GetAnnotations(), route.GetNamespace()+"/"+route.GetName())
+	entries := []DNSEntry{}
+	for _, fqdn := range fqdns {
+		entries = append(entries, newDNSEntries(fqdn, ttl, dedupe(targets[fqdn])...)...)
+	}
+	return entries
+}
+
+func dedupe(values []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// routeKey returns the workqueue key of a route, its kind is part of the key as every route kind shares the queue
+func routeKey(route *unstructured.Unstructured) string {
+	return strings.ToLower(route.GetKind()) + "/" + route.GetNamespace() + "/" + route.GetName()
+}
+
+// Keys returns the key of a route, or the keys of every route attached to a Gateway
+func (t *GatewayHandler) Keys(obj interface{}) []string {
+	u := obj.(*unstructured.Unstructured)
+	if !isGateway(u) {
+		return []string{ routeKey(u) }
+	}
+	keys := []string{}
+	for _, route := range t.attachedRoutes(u.GetNamespace(), u.GetName()) {
+		keys = append(keys, routeKey(route))
+	}
+	return keys
+}
+
+// getRoute returns the cached route with key, nil once it is deleted
+func (t *GatewayHandler) getRoute(key string) (*unstructured.Unstructured, error) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid route key %q", key)
+	}
+	for _, idx := range t.routes {
+		obj, exists, err := idx.GetByKey(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		if route := obj.(*unstructured.Unstructured); strings.ToLower(route.GetKind()) == parts[0] {
+			return route, nil
+		}
+	}
+	return nil, nil
+}
+
+// Object returns the cached route with key
+func (t *GatewayHandler) Object(key string) (meta_v1.Object, schema.GroupVersionResource) {
+	gvr := GatewayRouteResources[strings.SplitN(key, "/", 2)[0]]
+	route, err := t.getRoute(key)
+	if err != nil || route == nil {
+		return nil, gvr
+	}
+	return route, gvr
+}
+
+// Desired returns the records of the cached route with key, resolved against the cached Gateways, none once it is deleted
+func (t *GatewayHandler) Desired(key string) ([]DNSEntry, error) {
+	route, err := t.getRoute(key)
+	if err != nil {
+		return nil, err
+	}
+	if route == nil {
+		klog.Infof("GatewayHandler.Desired: route %s deleted", key)
+		return nil, nil
+	}
+	return allowed(key, t.entries(route)), nil
+}
+
+// publishedEndpoints returns the records every cached route publishes
+func (t *GatewayHandler) publishedEndpoints() []*endpoint.Endpoint {
+	desired := []*endpoint.Endpoint{}
+	for _, idx := range t.routes {
+		for _, obj := range idx.List() {
+			route := obj.(*unstructured.Unstructured)
+			if terminating(route) {
+				continue
+			}
+			desired = append(desired, toEndpoints(routeKey(route), t.entries(route))...)
+		}
+	}
+	return desired
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// gatewayObject returns a Gateway API object of kind with the spec & status
+func gatewayObject(kind, namespace, name string, spec, status map[string]interface{}) *unstructured.Unstructured {
+	obj := map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind": kind,
+		"metadata": map[string]interface{}{ "namespace": namespace, "name": name },
+		"spec": spec,
+	}
+	if status != nil {
+		obj["status"] = status
+	}
+	return &unstructured.Unstructured{ Object: obj }
+}
+
+// listener returns a Gateway listener, without a hostname when hostname is empty
+func listener(name string, port int64, hostname string) map[string]interface{} {
+	l := map[string]interface{}{ "name": name, "port": port, "protocol": "HTTP" }
+	if hostname != "" {
+		l["hostname"] = hostname
+	}
+	return l
+}
+
+// addresses returns the status of a Gateway with the addresses
+func addresses(values ...string) map[string]interface{} {
+	list := []interface{}{}
+	for _, v := range values {
+		list = append(list, map[string]interface{}{ "type": "IPAddress", "value": v })
+	}
+	return map[string]interface{}{ "addresses": list }
+}
+
+func TestIntersectHostname(t *testing.T) {
+	tests := []struct {
+		listener string
+		route    string
+		want     string
+		ok       bool
+	}{
+		{ listener: "", route: "app.corp.internal", want: "app.corp.internal", ok: true },
+		{ listener: "app.corp.internal", route: "app.corp.internal", want: "app.corp.internal", ok: true },
+		{ listener: "web.corp.internal", route: "app.corp.internal", ok: false },
+		{ listener: "*.corp.internal", route: "app.corp.internal", want: "app.corp.internal", ok: true },
+		{ listener: "*.corp.internal", route: "app.team.corp.internal", want: "app.team.corp.internal", ok: true },
+		{ listener: "*.corp.internal", route: "corp.internal", ok: false },
+		{ listener: "*.corp.internal", route: "app.mycorp.internal", ok: false },
+		{ listener: "app.corp.internal", route: "*.corp.internal", want: "app.corp.internal", ok: true },
+		{ listener: "app.other.internal", route: "*.corp.internal", ok: false },
+		{ listener: "*.corp.internal", route: "*.corp.internal", want: "*.corp.internal", ok: true },
+	}
+	for _, tt := range tests {
+		got, ok := intersectHostname(tt.listener, tt.route)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("intersectHostname(%q, %q) = %q, %v, want %q, %v", tt.listener, tt.route, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestListenerHostnames(t *testing.T) {
+	gw := gatewayObject("Gateway", "infra", "gw", map[string]interface{}{
+		"listeners": []interface{}{
+			listener("wildcard", 80, "*.corp.internal"),
+			listener("web", 443, "web.corp.internal"),
+			listener("any", 8080, ""),
+		},
+	}, nil)
+
+	tests := []struct {
+		name       string
+		ref        map[string]interface{}
+		routeHosts []string
+		want       []string
+	}{
+		{
+			name: "every listener",
+			ref: map[string]interface{}{ "name": "gw" },
+			routeHosts: []string{ "app.corp.internal", "web.corp.internal" },
+			want: []string{ "app.corp.internal", "web.corp.internal", "web.corp.internal", "app.corp.internal", "web.corp.internal" },
+		},
+		{
+			name: "section name",
+			ref: map[string]interface{}{ "name": "gw", "sectionName": "web" },
+			routeHosts: []string{ "app.corp.internal", "web.corp.internal" },
+			want: []string{ "web.corp.internal" },
+		},
+		{
+			name: "port",
+			ref: map[string]interface{}{ "name": "gw", "port": int64(80) },
+			routeHosts: []string{ "app.corp.internal", "app.other.internal" },
+			want: []string{ "app.corp.internal" },
+		},
+		{
+			name: "wildcard route on a listener hostname",
+			ref: map[string]interface{}{ "name": "gw", "sectionName": "web" },
+			routeHosts: []string{ "*.corp.internal" },
+			want: []string{ "web.corp.internal" },
+		},
+		{
+			name: "route without hostnames takes the listener hostnames",
+			ref: map[string]interface{}{ "name": "gw" },
+			want: []string{ "*.corp.internal", "web.corp.internal" },
+		},
+		{
+			name: "unknown section name",
+			ref: map[string]interface{}{ "name": "gw", "sectionName": "missing" },
+			routeHosts: []string{ "app.corp.internal" },
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listenerHostnames(gw, tt.ref, tt.routeHosts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listenerHostnames = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayHandlerEntries(t *testing.T) {
+	gateways := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, gw := range []*unstructured.Unstructured{
+		gatewayObject("Gateway", "infra", "public", map[string]interface{}{
+			"listeners": []interface{}{ listener("http", 80, "*.corp.internal") },
+		}, addresses("10.0.0.1", "10.0.0.2")),
+		gatewayObject("Gateway", "infra", "internal", map[string]interface{}{
+			"listeners": []interface{}{ listener("http", 80, "") },
+		}, addresses("lb.corp.internal")),
+		gatewayObject("Gateway", "infra", "pending", map[string]interface{}{
+			"listeners": []interface{}{ listener("http", 80, "") },
+		}, nil),
+	} {
+		if err := gateways.Add(gw); err != nil {
+			t.Fatalf("adding %s: %v", gw.GetName(), err)
+		}
+	}
+	h := &GatewayHandler{ gateways: gateways }
+
+	route := func(hostnames []string, refs ...map[string]interface{}) *unstructured.Unstructured {
+		parentRefs := []interface{}{}
+		for _, r := range refs {
+			parentRefs = append(parentRefs, r)
+		}
+		return gatewayObject("HTTPRoute", "apps", "web", map[string]interface{}{
+			"hostnames": values(hostnames...),
+			"parentRefs": parentRefs,
+		}, nil)
+	}
+
+	tests := []struct {
+		name  string
+		route *unstructured.Unstructured
+		want  []string
+	}{
+		{
+			name: "route under listener wildcard",
+			route: route([]string{ "web.corp.internal" }, map[string]interface{}{ "name": "public", "namespace": "infra" }),
+			want: []string{ "web.corp.internal A 10.0.0.1;10.0.0.2" },
+		},
+		{
+			name: "route outside listener hostname",
+			route: route([]string{ "web.example.com" }, map[string]interface{}{ "name": "public", "namespace": "infra" }),
+			want: []string{},
+		},
+		{
+			name: "hostname address",
+			route: route([]string{ "web.example.com" }, map[string]interface{}{ "name": "internal", "namespace": "infra" }),
+			want: []string{ "web.example.com CNAME lb.corp.internal" },
+		},
+		{
+			name: "parent in the route namespace is missing",
+			route: route([]string{ "web.corp.internal" }, map[string]interface{}{ "name": "public" }),
+			want: []string{},
+		},
+		{
+			name: "gateway without addresses",
+			route: route([]string{ "web.corp.internal" }, map[string]interface{}{ "name": "pending", "namespace": "infra" }),
+			want: []string{},
+		},
+		{
+			name: "parent of another kind",
+			route: route([]string{ "web.corp.internal" }, map[string]interface{}{ "name": "public", "namespace": "infra", "kind": "Service", "group": "" }),
+			want: []string{},
+		},
+		{
+			name: "several parents",
+			route: route([]string{ "web.corp.internal", "web.example.com" },
+				map[string]interface{}{ "name": "public", "namespace": "infra" },
+				map[string]interface{}{ "name": "internal", "namespace": "infra" }),
+			want: []string{ "web.corp.internal CNAME lb.corp.internal", "web.example.com CNAME lb.corp.internal" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, e := range h.entries(tt.route) {
+				got = append(got, e.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
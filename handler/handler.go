@@ -1,61 +1,173 @@
 package handler
 
 import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
 	"private-dns/endpoint"
 	"private-dns/plan"
+	"private-dns/provider"
 )
 
 // Handler interface contains the methods that are required
 type Handler interface {
-	ApplyChanges(changes HashableDNSChanges) error
-	ObjectCreated(obj interface{}) HashableDNSChanges 
-	ObjectDeleted(obj interface{}) HashableDNSChanges
-	ObjectUpdated(objOld, objNew interface{}) HashableDNSChanges
+	ApplyChanges(ctx context.Context, changes HashableDNSChanges) error
+	// Keys returns the workqueue keys of the objects whose records may change when obj changes
+	Keys(obj interface{}) []string
+	// Desired returns the records the object with key should publish, read from the informer caches (none once it is deleted)
+	Desired(key string) ([]DNSEntry, error)
+	// Object returns the cached object with key & its resource, nil once it is deleted or for a key naming no single object
+	Object(key string) (meta_v1.Object, schema.GroupVersionResource)
+	// Ping checks the provider's zones can be listed
+	Ping(ctx context.Context) error
+	// Plan compares the records every cached object should publish with those in the zones, and returns the difference
+	Plan(ctx context.Context, policies []plan.Policy) (*plan.Changes, error)
+	// Reconcile applies the difference the Plan returns
+	Reconcile(ctx context.Context, policies []plan.Policy) error
+	// Apply applies the changes of an earlier Plan, failing if the records they change have changed since
+	Apply(ctx context.Context, changes *plan.Changes) error
 }
 
-// DNSEntry yea
+// DNSEntry is a record an object publishes
 type DNSEntry struct {
 	fqdn string
 	recordtype string
 	ttl int
-	ip string
+	// targets are joined with ";" (as endpoint.Targets.String does), so DNSEntry
+	// stays comparable and can still be carried on the workqueue
+	targets string
 }
-// HashableDNSChanges yea
+// HashableDNSChanges is the change to a single fqdn, old is empty for a create & new is empty for a delete
 type HashableDNSChanges struct {
 	old DNSEntry
 	new DNSEntry
 }
 
+// newDNSEntries returns an A record set when every target is an IP address, otherwise a CNAME to the first hostname,
+// IPv6 addresses are skipped as AAAA records are not published, so there is no record when only IPv6 addresses are left
+func newDNSEntries(fqdn string, ttl int, targets ...string) []DNSEntry {
+	ips := []string{}
+	for _, t := range targets {
+		ip := net.ParseIP(t)
+		if ip == nil {
+			return []DNSEntry{ { fqdn: fqdn, recordtype: endpoint.RecordTypeCNAME, ttl: ttl, targets: t } }
+		}
+		if ip.To4() == nil {
+			klog.Infof("%s: skipping the IPv6 address %s, AAAA records are not supported", fqdn, t)
+			continue
+		}
+		ips = append(ips, ip.To4().String())
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	sort.Strings(ips)
+	return []DNSEntry{ { fqdn: fqdn, recordtype: endpoint.RecordTypeA, ttl: ttl, targets: endpoint.NewTargets(ips...).String() } }
+}
+
+// NewDNSEntry returns a record of recordType, so a Handler outside this package can return the records its objects publish
+func NewDNSEntry(fqdn, recordType string, ttl int, targets ...string) DNSEntry {
+	return DNSEntry{ fqdn: fqdn, recordtype: recordType, ttl: ttl, targets: endpoint.NewTargets(targets...).String() }
+}
+
+// FQDN returns the name of the record
+func (e DNSEntry) FQDN() string {
+	return e.fqdn
+}
+
+// RecordType returns the type of the record, A or CNAME
+func (e DNSEntry) RecordType() string {
+	return e.recordtype
+}
+
+// Targets returns the IPs or hostname the record points at
+func (e DNSEntry) Targets() []string {
+	return e.targetList()
+}
 
+func (e DNSEntry) String() string {
+	return e.fqdn + " " + e.recordtype + " " + e.targets
+}
 
-// HashDNSToPlan Plan is not hashable, so not able to add to workqueue
+func (e DNSEntry) targetList() []string {
+	return strings.Split(e.targets, ";")
+}
+
+// diffEntries pairs the entries an object published before and after a change by fqdn,
+// returning one HashableDNSChanges per fqdn that needs to be created, updated or deleted
+func diffEntries(oldEntries, newEntries []DNSEntry) []HashableDNSChanges {
+	changes := []HashableDNSChanges{}
+
+	oldByName := map[string]DNSEntry{}
+	for _, e := range oldEntries {
+		oldByName[e.fqdn] = e
+	}
+	for _, e := range newEntries {
+		if old, ok := oldByName[e.fqdn]; ok {
+			delete(oldByName, e.fqdn)
+			if old != e {
+				changes = append(changes, HashableDNSChanges{ old: old, new: e })
+			}
+		} else {
+			changes = append(changes, HashableDNSChanges{ new: e })
+		}
+	}
+	for _, e := range oldEntries {
+		if _, ok := oldByName[e.fqdn]; ok {
+			changes = append(changes, HashableDNSChanges{ old: e })
+		}
+	}
+	return changes
+}
+
+// newProvider returns the Azure provider for either public or private zones
+func newProvider(publicZone bool, azureAuth provider.AzureAuth, resourceGroup string, subID string) (provider.Provider, error) {
+	if publicZone {
+		klog.Info("Creating Azure Provider")
+		return provider.NewAzureProvider(azureAuth, resourceGroup, subID)
+	}
+	klog.Info("Creating Azure Private Provider")
+	return provider.NewAzurePrivateProvider(azureAuth, resourceGroup, subID)
+}
+
+
+// HashDNSToPlan Plan is not hashable, so not able to add to workqueue, the changes are limited by the SetPolicy policy
 func HashDNSToPlan(changes HashableDNSChanges) (plan.Changes, bool) {
 	apply := plan.Changes{}
 	applyIt := false
 
 	if changes.old != (DNSEntry{}) && changes.new != (DNSEntry{}) {
-		klog.Infof("HashDNSToPlan: Update  %s  %s", changes.new.fqdn, changes.new.ip)
+		klog.Infof("HashDNSToPlan: Update  %s  %s", changes.new.fqdn, changes.new.targets)
 		apply = plan.Changes{ 
-			UpdateOld: []*endpoint.Endpoint{ endpoint.NewEndpointWithTTL(changes.old.fqdn, changes.old.recordtype , endpoint.TTL(changes.old.ttl), changes.old.ip) },
-			UpdateNew: []*endpoint.Endpoint{ endpoint.NewEndpointWithTTL(changes.new.fqdn, changes.new.recordtype , endpoint.TTL(changes.old.ttl), changes.new.ip) },
+			UpdateOld: []*endpoint.Endpoint{ changes.old.endpoint("") },
+			UpdateNew: []*endpoint.Endpoint{ changes.new.endpoint("") },
 		}
 		applyIt = true
 	} else if changes.new != (DNSEntry{}) {
-		klog.Infof("HashDNSToPlan: Add %s  %s", changes.new.fqdn, changes.new.ip)
+		klog.Infof("HashDNSToPlan: Add %s  %s", changes.new.fqdn, changes.new.targets)
 		apply = plan.Changes{ 
-			Create: []*endpoint.Endpoint{ endpoint.NewEndpointWithTTL(changes.new.fqdn, changes.new.recordtype , endpoint.TTL(changes.old.ttl), changes.new.ip) },
+			Create: []*endpoint.Endpoint{ changes.new.endpoint("") },
 		}
 		applyIt = true
 	} else if changes.old != (DNSEntry{}) {
 		klog.Info("HashDNSToPlan: Delete")
 		apply = plan.Changes{ 
-			Delete: []*endpoint.Endpoint{ endpoint.NewEndpointWithTTL(changes.old.fqdn, changes.old.recordtype , endpoint.TTL(changes.old.ttl), changes.old.ip) },
+			Delete: []*endpoint.Endpoint{ changes.old.endpoint("") },
 		}
 		applyIt = true
 	} else {
 		klog.Info("DNSHandler: Nothing to do")
 	}
+
+	if applyIt {
+		apply = *applyPolicies(&apply, []plan.Policy{ currentPolicy() })
+		applyIt = !NoChanges(&apply)
+	}
 	return apply, applyIt
 }
 
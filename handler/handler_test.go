@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewDNSEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		want    []string
+	}{
+		{ name: "no targets", want: []string{} },
+		{ name: "IPv4 addresses, sorted", targets: []string{ "10.0.0.2", "10.0.0.1" }, want: []string{ "app.corp.internal A 10.0.0.1;10.0.0.2" } },
+		{ name: "hostname", targets: []string{ "lb.corp.internal" }, want: []string{ "app.corp.internal CNAME lb.corp.internal" } },
+		{ name: "hostname among addresses", targets: []string{ "10.0.0.1", "lb.corp.internal" }, want: []string{ "app.corp.internal CNAME lb.corp.internal" } },
+		{ name: "dual-stack", targets: []string{ "fd00::1", "10.0.0.1" }, want: []string{ "app.corp.internal A 10.0.0.1" } },
+		{ name: "IPv6 only", targets: []string{ "fd00::1", "fd00::2" }, want: []string{} },
+		{ name: "IPv4-mapped IPv6", targets: []string{ "::ffff:10.0.0.1" }, want: []string{ "app.corp.internal A 10.0.0.1" } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, e := range newDNSEntries("app.corp.internal", 300, tt.targets...) {
+				got = append(got, e.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newDNSEntries(%v) = %v, want %v", tt.targets, got, tt.want)
+			}
+		})
+	}
+}
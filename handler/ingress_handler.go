@@ -2,124 +2,119 @@ package handler
 
 import (
 	"k8s.io/klog/v2"
-	"private-dns/endpoint"
 
 
-	"context"
+	"text/template"
 
 	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"private-dns/endpoint"
 	"private-dns/provider"
 
 )
 
 // IngressHandler is a sample implementation of Handler
 type IngressHandler struct{
-	Provider provider.Provider
+	zoneHandler
+	ingresses cache.Indexer
+	// fqdnTemplate names class annotated Ingresses without a rule host, nil to skip them
+	fqdnTemplate *template.Template
 }
 
 // NewIngressHandler returns a Handler.
-func NewIngressHandler(inCluster bool, resourceGroup string, subID string) (*IngressHandler, error) {
+func NewIngressHandler(azureAuth provider.AzureAuth, resourceGroup string, subID string, fqdnTemplate *template.Template, ingresses cache.SharedIndexInformer) (*IngressHandler, error) {
 
 	klog.Info("NewIngressHandler - Creating Azure Private Provider")
 
-	p, err := provider.NewAzureProvider(inCluster, resourceGroup, subID)
+	p, err := provider.NewAzureProvider(azureAuth, resourceGroup, subID)
 	if err != nil {
 		klog.Fatalf("failed to create NewAzureProvider: %v", err)
 		return nil, err
 	}
 
-	return &IngressHandler{ Provider: p}, nil
-}
-
-// ObjectCreated is called when an object is created
-func (t *IngressHandler) ObjectCreated(obj interface{}) HashableDNSChanges {
-	klog.Info("IngressHandler.ObjectCreated")
-	// assert the type to a Ingress object to pull out relevant data
-	//service := obj.(*extensionsv1beta1.Ingress)
-	//klog.Infof("    ResourceVersion: %s", service.ObjectMeta.ResourceVersion)
-	//klog.Infof("    Ingress Rules: %v", service.Spec.Rules[0].Host)
-	//klog.Infof("    Status: %s", service.Status.LoadBalancer.Ingress[0].IP)
-	return HashableDNSChanges{}
+	h := &IngressHandler{ ingresses: ingresses.GetIndexer(), fqdnTemplate: fqdnTemplate}
+	h.zoneHandler = newZoneHandler("IngressHandler", p, h.publishedEndpoints)
+	return h, nil
 }
 
-// ObjectDeleted is called when an object is deleted
-func (t *IngressHandler) ObjectDeleted(obj interface{}) HashableDNSChanges {
-	klog.Info("IngressHandler.ObjectDeleted")
-	oldI := obj.(*extensionsv1beta1.Ingress)
+// entries returns the record a class annotated Ingress with a rule host & IP (or target annotation) should publish,
+// an Ingress without a rule host is named by the fqdnTemplate, if one is set, with a *TemplateError if it fails
+func (t *IngressHandler) entries(i *extensionsv1beta1.Ingress) ([]DNSEntry, error) {
+	ip :=  ""
+	if len(i.Status.LoadBalancer.Ingress)>0 { ip = i.Status.LoadBalancer.Ingress[0].IP }
 
-	oldFQDN := ""
-	if len(oldI.Spec.Rules) > 0 { oldFQDN = oldI.Spec.Rules[0].Host } 
-	
-	oldIP :=  ""
-	if len(oldI.Status.LoadBalancer.Ingress)>0 { oldIP = oldI.Status.LoadBalancer.Ingress[0].IP }
-
-	oldEntry := len(oldI.Annotations["kubernetes.io/ingress.class"])>0 && oldFQDN != "" && oldIP != ""
+	targets := []string{ ip }
+	if override, ok := targetOverride(i.Annotations, i.Namespace+"/"+i.Name); ok {
+		targets = override
+	}
 
-	// messy, but lets encrypt creates an identical ingress for .well-known check, so dont delete
-	itsNotLetsEncrypt := len(oldI.Annotations["nginx.ingress.kubernetes.io/whitelist-source-range"]) == 0
+	if len(i.Annotations["kubernetes.io/ingress.class"]) == 0 || targets[0] == "" {
+		return nil, nil
+	}
 
-	if oldEntry && itsNotLetsEncrypt {
-		return HashableDNSChanges{  old: DNSEntry{ fqdn: oldFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: oldIP} } 
+	fqdns := []string{}
+	var err error
+	if len(i.Spec.Rules) > 0 && i.Spec.Rules[0].Host != "" {
+		fqdns = append(fqdns, i.Spec.Rules[0].Host)
+	} else if fqdns, err = templateFQDNs(t.fqdnTemplate, i, i.Namespace+"/"+i.Name); err != nil {
+		return nil, err
 	}
-	return HashableDNSChanges{}
 
+	ttl := recordTTL(i.Annotations, i.Namespace+"/"+i.Name)
+	entries := []DNSEntry{}
+	for _, fqdn := range fqdns {
+		entries = append(entries, newDNSEntries(fqdn, ttl, targets...)...)
+	}
+	return entries, nil
 }
 
-// ObjectUpdated is called when an object is updated
-func (t *IngressHandler) ObjectUpdated(objOld, objNew interface{}) HashableDNSChanges {
-	klog.Info("IngressHandler.ObjectUpdated")
-	oldI := objOld.(*extensionsv1beta1.Ingress)
-	newI := objNew.(*extensionsv1beta1.Ingress)
-
-	oldFQDN := ""
-	if len(oldI.Spec.Rules) > 0 { oldFQDN = oldI.Spec.Rules[0].Host } 
-
-	oldIP :=  ""
-	if len(oldI.Status.LoadBalancer.Ingress)>0 { oldIP = oldI.Status.LoadBalancer.Ingress[0].IP }
-
-	oldEntry := len(oldI.Annotations["kubernetes.io/ingress.class"])>0 && oldFQDN != "" && oldIP != ""
-
-	newFQDN := ""
-	if len(newI.Spec.Rules) > 0 { newFQDN = newI.Spec.Rules[0].Host } 
-
-	newIP := ""
-	if len(newI.Status.LoadBalancer.Ingress)>0 { newIP =  newI.Status.LoadBalancer.Ingress[0].IP }
-
-	changes := HashableDNSChanges{}
-
-	klog.Infof("IngressHandler.ObjectUpdated: Got Ingress, required fqdn=%s ip=%s", newFQDN, newIP)
-
-	if len(newI.Annotations["kubernetes.io/ingress.class"])>0 && newFQDN != "" && newIP != "" {
-		klog.Info("IngressHandler: Got updated Ingress with fqdn & IP")
-		if oldEntry {
-			if oldFQDN != newFQDN || oldIP != newIP {
-				changes.old = DNSEntry{ fqdn: oldFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: oldIP}
-				changes.new = DNSEntry{ fqdn: newFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: newIP}
-			}
-		} else {
-			changes.new = DNSEntry{ fqdn: newFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: newIP}
-		}
-	} else if (oldEntry) {
-		changes.old = DNSEntry{ fqdn: oldFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: oldIP}
-	} 
-
-	return changes
+// Keys returns the key of the Ingress
+func (t *IngressHandler) Keys(obj interface{}) []string {
+	i := obj.(*extensionsv1beta1.Ingress)
+	return []string{ i.Namespace + "/" + i.Name }
 }
 
+// Object returns the cached Ingress with key
+func (t *IngressHandler) Object(key string) (meta_v1.Object, schema.GroupVersionResource) {
+	gvr := extensionsv1beta1.SchemeGroupVersion.WithResource("ingresses")
+	obj, exists, err := t.ingresses.GetByKey(key)
+	if err != nil || !exists {
+		return nil, gvr
+	}
+	return obj.(*extensionsv1beta1.Ingress), gvr
+}
 
-
-
-// ApplyChanges comment
-func (t *IngressHandler) ApplyChanges(changes HashableDNSChanges) error {
-
-	apply, applyIt :=HashDNSToPlan (changes)
-	
-	if applyIt {
-		klog.Info("IngressHandler: ApplyChanges")
-		return t.Provider.ApplyChanges(context.Background(), &apply)
+// Desired returns the records of the cached Ingress with key, none once it is deleted. Ingresses sharing
+// a host (eg the one lets encrypt creates for the .well-known check) keep the record until the last is deleted
+func (t *IngressHandler) Desired(key string) ([]DNSEntry, error) {
+	obj, exists, err := t.ingresses.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		klog.Infof("IngressHandler.Desired: Ingress %s deleted", key)
+		return nil, nil
 	}
 
-	klog.Info("IngressHandler: Nothing Applied")
-	return nil
+	entries, err := t.entries(obj.(*extensionsv1beta1.Ingress))
+	entries = allowed(key, entries)
+	klog.Infof("IngressHandler.Desired: Got Ingress %s, required %v", key, entries)
+	return entries, err
 }
 
+// publishedEndpoints returns the records every cached Ingress publishes
+func (t *IngressHandler) publishedEndpoints() []*endpoint.Endpoint {
+	desired := []*endpoint.Endpoint{}
+	for _, obj := range t.ingresses.List() {
+		i := obj.(*extensionsv1beta1.Ingress)
+		if terminating(i) {
+			continue
+		}
+		// a template failure is reported by the sync of the Ingress, it publishes nothing here either
+		entries, _ := t.entries(i)
+		desired = append(desired, toEndpoints("ingress/"+i.Namespace+"/"+i.Name, entries)...)
+	}
+	return desired
+}
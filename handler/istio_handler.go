@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"k8s.io/klog/v2"
+
+	"fmt"
+	"strings"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"private-dns/endpoint"
+	"private-dns/provider"
+)
+
+// Istio resources watched by the IstioHandler
+var (
+	IstioGatewayResource        = schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "gateways"}
+	IstioVirtualServiceResource = schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "virtualservices"}
+)
+
+// IstioHandler publishes the hosts of Istio Gateways and of the VirtualServices bound to them,
+// with the targets taken from the LoadBalancer status of the ingress-gateway Services the Gateway selects
+type IstioHandler struct{
+	zoneHandler
+	gateways        cache.Indexer
+	virtualServices cache.Indexer
+	services        cache.Indexer
+}
+
+// NewIstioHandler returns a Handler, the informers are used to look up Gateways, VirtualServices & the ingress-gateway Services
+func NewIstioHandler(publicZone bool, azureAuth provider.AzureAuth, resourceGroup string, subID string, gateways, virtualServices, services cache.SharedIndexInformer) (*IstioHandler, error) {
+
+	klog.Info("NewIstioHandler - Creating Azure Provider")
+
+	p, err := newProvider(publicZone, azureAuth, resourceGroup, subID)
+	if err != nil {
+		klog.Fatalf("failed to create Azure Provider: %v", err)
+		return nil, err
+	}
+
+	h := &IstioHandler{
+		gateways: gateways.GetIndexer(),
+		virtualServices: virtualServices.GetIndexer(),
+		services: services.GetIndexer(),
+	}
+	h.zoneHandler = newZoneHandler("IstioHandler", p, h.publishedEndpoints)
+	return h, nil
+}
+
+// istioView is the state used to work out records, read from the informer caches
+type istioView struct {
+	gateway  func(namespace, name string) *unstructured.Unstructured
+	services func() []*core_v1.Service
+}
+
+func (t *IstioHandler) cached() istioView {
+	return istioView{
+		gateway: func(namespace, name string) *unstructured.Unstructured {
+			obj, exists, err := t.gateways.GetByKey(namespace + "/" + name)
+			if err != nil || !exists || terminating(obj.(*unstructured.Unstructured)) {
+				return nil
+			}
+			return obj.(*unstructured.Unstructured)
+		},
+		services: func() []*core_v1.Service {
+			services := []*core_v1.Service{}
+			for _, obj := range t.services.List() {
+				services = append(services, obj.(*core_v1.Service))
+			}
+			return services
+		},
+	}
+}
+
+// gatewayTargets returns the LoadBalancer addresses of the Services selected by the Gateway's spec.selector
+func (v istioView) gatewayTargets(gw *unstructured.Unstructured) []string {
+	selector, _, _ := unstructured.NestedStringMap(gw.Object, "spec", "selector")
+	if len(selector) == 0 {
+		return nil
+	}
+	sel := labels.SelectorFromSet(selector)
+
+	targets := []string{}
+	for _, svc := range v.services() {
+		if !sel.Matches(labels.Set(svc.Spec.Selector)) {
+			continue
+		}
+		for _, lb := range svc.Status.LoadBalancer.Ingress {
+			if lb.IP != "" {
+				targets = append(targets, lb.IP)
+			} else if lb.Hostname != "" {
+				targets = append(targets, lb.Hostname)
+			}
+		}
+	}
+	return dedupe(targets)
+}
+
+// gatewayHosts returns the server hosts of the Gateway, each split into its namespace & host parts
+func gatewayHosts(gw *unstructured.Unstructured) [][2]string {
+	hosts := [][2]string{}
+	servers, _, _ := unstructured.NestedSlice(gw.Object, "spec", "servers")
+	for _, s := range servers {
+		server, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		serverHosts, _, _ := unstructured.NestedStringSlice(server, "hosts")
+		for _, h := range serverHosts {
+			ns := "*"
+			if parts := strings.SplitN(h, "/", 2); len(parts) == 2 {
+				ns, h = parts[0], parts[1]
+				if ns == "." {
+					ns = gw.GetNamespace()
+				}
+			}
+			hosts = append(hosts, [2]string{ns, h})
+		}
+	}
+	return hosts
+}
+
+// istioHostMatches returns true if host is covered by the (possibly wildcard) gateway host
+func istioHostMatches(gatewayHost, host string) bool {
+	switch {
+	case gatewayHost == "*" || gatewayHost == host:
+		return true
+	case strings.HasPrefix(gatewayHost, "*."):
+		return strings.HasSuffix(host, gatewayHost[1:])
+	}
+	return false
+}
+
+// gatewayEntries returns the records for the Gateway's own server hosts
+func (v istioView) gatewayEntries(gw *unstructured.Unstructured) []DNSEntry {
+	targets := v.gatewayTargets(gw)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	ttl := recordTTL(gw.GetAnnotations(), gw.GetNamespace()+"/"+gw.GetName())
+	entries := []DNSEntry{}
+	seen := map[string]bool{}
+	for _, h := range gatewayHosts(gw) {
+		if h[1] == "*" || seen[h[1]] {
+			continue
+		}
+		seen[h[1]] = true
+		entries = append(entries, newDNSEntries(h[1], ttl, targets...)...)
+	}
+	return entries
+}
+
+// virtualServiceGateways returns the namespace & name of the Gateways the VirtualService is bound to, ignoring the "mesh" gateway
+func virtualServiceGateways(vs *unstructured.Unstructured) [][2]string {
+	refs := [][2]string{}
+	gateways, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "gateways")
+	for _, g := range gateways {
+		if g == "mesh" {
+			continue
+		}
+		if parts := strings.SplitN(g, "/", 2); len(parts) == 2 {
+			refs = append(refs, [2]string{parts[0], parts[1]})
+		} else {
+			refs = append(refs, [2]string{vs.GetNamespace(), g})
+		}
+	}
+	return refs
+}
+
+// virtualServiceEntries returns the records for the VirtualService hosts exposed by its Gateways
+func (v istioView) virtualServiceEntries(vs *unstructured.Unstructured) []DNSEntry {
+	hosts, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "hosts")
+
+	targets := map[string][]string{}
+	fqdns := []string{}
+	for _, ref := range virtualServiceGateways(vs) {
+		gw := v.gateway(ref[0], ref[1])
+		if gw == nil {
+			continue
+		}
+		gwTargets := v.gatewayTargets(gw)
+		if len(gwTargets) == 0 {
+			continue
+		}
+		for _, host := range hosts {
+			if host == "*" {
+				continue
+			}
+			for _, gh := range gatewayHosts(gw) {
+				if (gh[0] == "*" || gh[0] == vs.GetNamespace()) && istioHostMatches(gh[1], host) {
+					if _, ok := targets[host]; !ok {
+						fqdns = append(fqdns, host)
+					}
+					targets[host] = append(targets[host], gwTargets...)
+					break
+				}
+			}
+		}
+	}
+
+	ttl := recordTTL(vs.GetAnnotations(), vs.GetNamespace()+"/"+vs.GetName())
+	entries := []DNSEntry{}
+	for _, fqdn := range fqdns {
+		entries = append(entries, newDNSEntries(fqdn, ttl, dedupe(targets[fqdn])...)...)
+	}
+	return entries
+}
+
+func (v istioView) entries(u *unstructured.Unstructured) []DNSEntry {
+	if u.GetKind() == "Gateway" {
+		return v.gatewayEntries(u)
+	}
+	return v.virtualServiceEntries(u)
+}
+
+// boundVirtualServices returns the cached VirtualServices bound to the Gateway namespace/name
+func (t *IstioHandler) boundVirtualServices(namespace, name string) []*unstructured.Unstructured {
+	bound := []*unstructured.Unstructured{}
+	for _, obj := range t.virtualServices.List() {
+		vs := obj.(*unstructured.Unstructured)
+		for _, ref := range virtualServiceGateways(vs) {
+			if ref[0] == namespace && ref[1] == name {
+				bound = append(bound, vs)
+				break
+			}
+		}
+	}
+	return bound
+}
+
+// istioKey returns the workqueue key of a Gateway or VirtualService
+func istioKey(u *unstructured.Unstructured) string {
+	return strings.ToLower(u.GetKind()) + "/" + u.GetNamespace() + "/" + u.GetName()
+}
+
+// gatewayKeys returns the keys of the Gateway namespace/name & the VirtualServices bound to it
+func (t *IstioHandler) gatewayKeys(namespace, name string) []string {
+	keys := []string{ "gateway/" + namespace + "/" + name }
+	for _, vs := range t.boundVirtualServices(namespace, name) {
+		keys = append(keys, istioKey(vs))
+	}
+	return keys
+}
+
+// Keys returns the keys of the records that may change with obj, for an ingress-gateway Service that is every
+// Gateway selecting it & the VirtualServices bound to those Gateways
+func (t *IstioHandler) Keys(obj interface{}) []string {
+	if s, ok := obj.(*core_v1.Service); ok {
+		keys := []string{}
+		for _, o := range t.gateways.List() {
+			gw := o.(*unstructured.Unstructured)
+			selector, _, _ := unstructured.NestedStringMap(gw.Object, "spec", "selector")
+			if len(selector) > 0 && labels.SelectorFromSet(selector).Matches(labels.Set(s.Spec.Selector)) {
+				keys = append(keys, t.gatewayKeys(gw.GetNamespace(), gw.GetName())...)
+			}
+		}
+		return keys
+	}
+	u := obj.(*unstructured.Unstructured)
+	if u.GetKind() == "Gateway" {
+		return t.gatewayKeys(u.GetNamespace(), u.GetName())
+	}
+	return []string{ istioKey(u) }
+}
+
+// get returns the cached Gateway or VirtualService with key & its resource, nil once it is deleted
+func (t *IstioHandler) get(key string) (*unstructured.Unstructured, schema.GroupVersionResource, error) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return nil, IstioVirtualServiceResource, fmt.Errorf("invalid istio key %q", key)
+	}
+	idx, gvr := t.virtualServices, IstioVirtualServiceResource
+	if parts[0] == "gateway" {
+		idx, gvr = t.gateways, IstioGatewayResource
+	}
+	obj, exists, err := idx.GetByKey(parts[1])
+	if err != nil || !exists {
+		return nil, gvr, err
+	}
+	return obj.(*unstructured.Unstructured), gvr, nil
+}
+
+// Object returns the cached Gateway or VirtualService with key
+func (t *IstioHandler) Object(key string) (meta_v1.Object, schema.GroupVersionResource) {
+	u, gvr, _ := t.get(key)
+	if u == nil {
+		return nil, gvr
+	}
+	return u, gvr
+}
+
+// Desired returns the records of the cached Gateway or VirtualService with key, none once it is deleted
+func (t *IstioHandler) Desired(key string) ([]DNSEntry, error) {
+	u, _, err := t.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		klog.Infof("IstioHandler.Desired: %s deleted", key)
+		return nil, nil
+	}
+	return allowed(key, t.cached().entries(u)), nil
+}
+
+// publishedEndpoints returns the records every cached Gateway & VirtualService publishes
+func (t *IstioHandler) publishedEndpoints() []*endpoint.Endpoint {
+	cached := t.cached()
+	desired := []*endpoint.Endpoint{}
+	for _, idx := range []cache.Indexer{ t.gateways, t.virtualServices } {
+		for _, obj := range idx.List() {
+			u := obj.(*unstructured.Unstructured)
+			if terminating(u) {
+				continue
+			}
+			desired = append(desired, toEndpoints(istioKey(u), cached.entries(u))...)
+		}
+	}
+	return desired
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// istioObject returns an Istio Gateway or VirtualService with the spec
+func istioObject(kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{ Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1beta1",
+		"kind": kind,
+		"metadata": map[string]interface{}{ "namespace": namespace, "name": name },
+		"spec": spec,
+	} }
+}
+
+// ingressService returns an ingress-gateway Service with the selector & LoadBalancer ingress
+func ingressService(name string, selector map[string]string, ingress core_v1.LoadBalancerIngress) *core_v1.Service {
+	return &core_v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{ Namespace: "istio-system", Name: name },
+		Spec: core_v1.ServiceSpec{ Type: core_v1.ServiceTypeLoadBalancer, Selector: selector },
+		Status: core_v1.ServiceStatus{ LoadBalancer: core_v1.LoadBalancerStatus{ Ingress: []core_v1.LoadBalancerIngress{ ingress } } },
+	}
+}
+
+// values returns s as the []interface{} of an unstructured string list
+func values(s ...string) []interface{} {
+	out := []interface{}{}
+	for _, v := range s {
+		out = append(out, v)
+	}
+	return out
+}
+
+func TestGatewayHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []interface{}
+		want    [][2]string
+	}{
+		{ name: "no servers", want: [][2]string{} },
+		{
+			name: "host without namespace",
+			servers: []interface{}{ map[string]interface{}{ "hosts": values("app.corp.internal") } },
+			want: [][2]string{ { "*", "app.corp.internal" } },
+		},
+		{
+			name: "namespace of the gateway",
+			servers: []interface{}{ map[string]interface{}{ "hosts": values("./app.corp.internal") } },
+			want: [][2]string{ { "istio-system", "app.corp.internal" } },
+		},
+		{
+			name: "namespace & wildcard",
+			servers: []interface{}{ map[string]interface{}{ "hosts": values("team/*.apps.corp.internal", "*/*") } },
+			want: [][2]string{ { "team", "*.apps.corp.internal" }, { "*", "*" } },
+		},
+		{
+			name: "several servers",
+			servers: []interface{}{
+				map[string]interface{}{ "hosts": values("a.corp.internal") },
+				map[string]interface{}{ "hosts": values("b.corp.internal") },
+			},
+			want: [][2]string{ { "*", "a.corp.internal" }, { "*", "b.corp.internal" } },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := map[string]interface{}{}
+			if tt.servers != nil {
+				spec["servers"] = tt.servers
+			}
+			gw := istioObject("Gateway", "istio-system", "gw", spec)
+			if got := gatewayHosts(gw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("gatewayHosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIstioHostMatches(t *testing.T) {
+	tests := []struct {
+		gatewayHost string
+		host        string
+		want        bool
+	}{
+		{ "*", "app.corp.internal", true },
+		{ "app.corp.internal", "app.corp.internal", true },
+		{ "*.corp.internal", "app.corp.internal", true },
+		{ "*.corp.internal", "app.team.corp.internal", true },
+		{ "*.corp.internal", "corp.internal", false },
+		{ "*.corp.internal", "app.mycorp.internal", false },
+		{ "web.corp.internal", "app.corp.internal", false },
+	}
+	for _, tt := range tests {
+		if got := istioHostMatches(tt.gatewayHost, tt.host); got != tt.want {
+			t.Errorf("istioHostMatches(%q, %q) = %v, want %v", tt.gatewayHost, tt.host, got, tt.want)
+		}
+	}
+}
+
+// newTestIstioHandler returns an IstioHandler whose caches are synced from fake clients, so no cluster is needed
+func newTestIstioHandler(t *testing.T, stop <-chan struct{}, services []runtime.Object, objects ...*unstructured.Unstructured) *IstioHandler {
+	// the objects are created with their resource, the fake client would guess "gatewaies" for a Gateway
+	dynClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	for _, obj := range objects {
+		gvr := IstioVirtualServiceResource
+		if obj.GetKind() == "Gateway" {
+			gvr = IstioGatewayResource
+		}
+		if _, err := dynClient.Resource(gvr).Namespace(obj.GetNamespace()).Create(obj, meta_v1.CreateOptions{}); err != nil {
+			t.Fatalf("creating %s: %v", istioKey(obj), err)
+		}
+	}
+
+	dynFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynClient, 0)
+	gateways := dynFactory.ForResource(IstioGatewayResource).Informer()
+	virtualServices := dynFactory.ForResource(IstioVirtualServiceResource).Informer()
+	kubeFactory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(services...), 0)
+	serviceInformer := kubeFactory.Core().V1().Services().Informer()
+
+	dynFactory.Start(stop)
+	kubeFactory.Start(stop)
+	dynFactory.WaitForCacheSync(stop)
+	kubeFactory.WaitForCacheSync(stop)
+
+	return &IstioHandler{ gateways: gateways.GetIndexer(), virtualServices: virtualServices.GetIndexer(), services: serviceInformer.GetIndexer() }
+}
+
+func TestIstioViewEntries(t *testing.T) {
+	services := []runtime.Object{
+		ingressService("ingressgateway", map[string]string{ "istio": "ingressgateway" }, core_v1.LoadBalancerIngress{ IP: "10.0.0.1" }),
+		ingressService("internalgateway", map[string]string{ "istio": "internalgateway" }, core_v1.LoadBalancerIngress{ Hostname: "lb.corp.internal" }),
+	}
+	gateway := func(namespace, name, selector string, hosts ...string) *unstructured.Unstructured {
+		return istioObject("Gateway", namespace, name, map[string]interface{}{
+			"selector": map[string]interface{}{ "istio": selector },
+			"servers": []interface{}{ map[string]interface{}{ "hosts": values(hosts...) } },
+		})
+	}
+	virtualService := func(namespace, name string, gateways []string, hosts ...string) *unstructured.Unstructured {
+		return istioObject("VirtualService", namespace, name, map[string]interface{}{
+			"gateways": values(gateways...),
+			"hosts": values(hosts...),
+		})
+	}
+	gateways := []*unstructured.Unstructured{
+		gateway("istio-system", "public", "ingressgateway", "*.apps.corp.internal", "gw.corp.internal", "*"),
+		gateway("apps", "team", "ingressgateway", "./team.corp.internal"),
+		gateway("istio-system", "internal", "internalgateway", "*.internal.corp.internal"),
+		gateway("istio-system", "unselected", "nothing", "unselected.corp.internal"),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	view := newTestIstioHandler(t, stop, services, gateways...).cached()
+
+	tests := []struct {
+		name string
+		obj  *unstructured.Unstructured
+		want []string
+	}{
+		{ name: "gateway hosts, not the catch-all", obj: gateways[0], want: []string{ "*.apps.corp.internal A 10.0.0.1", "gw.corp.internal A 10.0.0.1" } },
+		{ name: "gateway with hostname load balancer", obj: gateways[2], want: []string{ "*.internal.corp.internal CNAME lb.corp.internal" } },
+		{ name: "gateway selecting no service", obj: gateways[3], want: []string{} },
+		{
+			name: "virtual service under gateway wildcard",
+			obj: virtualService("apps", "web", []string{ "istio-system/public" }, "web.apps.corp.internal"),
+			want: []string{ "web.apps.corp.internal A 10.0.0.1" },
+		},
+		{
+			name: "virtual service host outside gateway hosts",
+			obj: virtualService("apps", "web", []string{ "istio-system/internal" }, "web.example.com"),
+			want: []string{},
+		},
+		{
+			name: "catch-all gateway host",
+			obj: virtualService("apps", "web", []string{ "istio-system/public" }, "web.example.com"),
+			want: []string{ "web.example.com A 10.0.0.1" },
+		},
+		{
+			name: "gateway in the namespace of the virtual service",
+			obj: virtualService("apps", "team", []string{ "team" }, "team.corp.internal"),
+			want: []string{ "team.corp.internal A 10.0.0.1" },
+		},
+		{
+			name: "gateway host restricted to another namespace",
+			obj: virtualService("other", "team", []string{ "apps/team" }, "team.corp.internal"),
+			want: []string{},
+		},
+		{
+			name: "mesh & missing gateways",
+			obj: virtualService("apps", "web", []string{ "mesh", "istio-system/missing" }, "web.apps.corp.internal"),
+			want: []string{},
+		},
+		{
+			name: "catch-all host of the virtual service",
+			obj: virtualService("apps", "web", []string{ "istio-system/public" }, "*"),
+			want: []string{},
+		},
+		{
+			name: "several gateways",
+			obj: virtualService("apps", "web", []string{ "istio-system/public", "istio-system/internal" }, "web.apps.corp.internal", "web.internal.corp.internal"),
+			want: []string{ "web.apps.corp.internal A 10.0.0.1", "web.internal.corp.internal CNAME lb.corp.internal" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, e := range view.entries(tt.obj) {
+				got = append(got, e.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"k8s.io/klog/v2"
+
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"private-dns/endpoint"
+	"private-dns/provider"
+)
+
+// NodeHandler publishes the addresses of Nodes, for hostNetwork & NodePort based workloads
+type NodeHandler struct{
+	zoneHandler
+	nodes cache.Indexer
+	// fqdnTemplate names the record of each node, executed against the Node object
+	fqdnTemplate *template.Template
+	// externalIP publishes ExternalIPs as well as InternalIPs
+	externalIP bool
+	// aggregateFQDN, if set, names a record listing the ready nodes matching aggregateSelector
+	aggregateFQDN     string
+	aggregateSelector labels.Selector
+}
+
+// NewNodeHandler returns a Handler, fqdnTemplate is a text/template over the Node, eg '{{.Name}}.nodes.corp.internal'
+func NewNodeHandler(publicZone bool, azureAuth provider.AzureAuth, resourceGroup string, subID string, nodes cache.SharedIndexInformer, fqdnTemplate string, externalIP bool, aggregateFQDN string, aggregateSelector string) (*NodeHandler, error) {
+
+	tmpl, err := template.New("node-fqdn").Option("missingkey=error").Parse(fqdnTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse node fqdn template: %v", err)
+	}
+
+	selector, err := labels.Parse(aggregateSelector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse node selector: %v", err)
+	}
+
+	klog.Info("NewNodeHandler - Creating Azure Provider")
+
+	p, err := newProvider(publicZone, azureAuth, resourceGroup, subID)
+	if err != nil {
+		klog.Fatalf("failed to create Azure Provider: %v", err)
+		return nil, err
+	}
+
+	h := &NodeHandler{
+		nodes: nodes.GetIndexer(),
+		fqdnTemplate: tmpl,
+		externalIP: externalIP,
+		aggregateFQDN: aggregateFQDN,
+		aggregateSelector: selector,
+	}
+	h.zoneHandler = newZoneHandler("NodeHandler", p, h.publishedEndpoints)
+	return h, nil
+}
+
+// nodeAddresses returns the InternalIPs, and ExternalIPs if enabled, of the node
+func (t *NodeHandler) nodeAddresses(n *core_v1.Node) []string {
+	ips := []string{}
+	for _, a := range n.Status.Addresses {
+		if a.Type == core_v1.NodeInternalIP || (t.externalIP && a.Type == core_v1.NodeExternalIP) {
+			ips = append(ips, a.Address)
+		}
+	}
+	return ips
+}
+
+func nodeReady(n *core_v1.Node) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == core_v1.NodeReady {
+			return c.Status == core_v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// entries returns the record of a schedulable node, with a *TemplateError if the fqdnTemplate fails for it
+func (t *NodeHandler) entries(n *core_v1.Node) ([]DNSEntry, error) {
+	if n == nil || n.Spec.Unschedulable {
+		return nil, nil
+	}
+	ips := t.nodeAddresses(n)
+	if len(ips) == 0 {
+		return nil, nil
+	}
+
+	var fqdn bytes.Buffer
+	if err := t.fqdnTemplate.Execute(&fqdn, n); err != nil {
+		klog.Errorf("NodeHandler: failed to execute fqdn template for node %s: %v", n.Name, err)
+		return nil, &TemplateError{ Object: n.Name, Err: err }
+	}
+	if fqdn.Len() == 0 {
+		return nil, nil
+	}
+	return newDNSEntries(fqdn.String(), recordTTL(n.Annotations, n.Name), ips...), nil
+}
+
+// aggregateEntries returns the aggregate record of the cached nodes
+func (t *NodeHandler) aggregateEntries() []DNSEntry {
+	if t.aggregateFQDN == "" {
+		return nil
+	}
+
+	ips := []string{}
+	for _, obj := range t.nodes.List() {
+		node := obj.(*core_v1.Node)
+		if !node.Spec.Unschedulable && !terminating(node) && nodeReady(node) && t.aggregateSelector.Matches(labels.Set(node.Labels)) {
+			ips = append(ips, t.nodeAddresses(node)...)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil
+	}
+	return newDNSEntries(t.aggregateFQDN, recordTTL(nil, t.aggregateFQDN), dedupe(ips)...)
+}
+
+// aggregateKey is the workqueue key of the aggregate record, which every node event may change
+const aggregateKey = "node"
+
+// Keys returns the key of the node, and of the aggregate record if one is set
+func (t *NodeHandler) Keys(obj interface{}) []string {
+	n := obj.(*core_v1.Node)
+	keys := []string{ "node/" + n.Name }
+	if t.aggregateFQDN != "" {
+		keys = append(keys, aggregateKey)
+	}
+	return keys
+}
+
+// Object returns the cached node with key, the aggregate record has no object of its own
+func (t *NodeHandler) Object(key string) (meta_v1.Object, schema.GroupVersionResource) {
+	gvr := core_v1.SchemeGroupVersion.WithResource("nodes")
+	if key == aggregateKey {
+		return nil, gvr
+	}
+	obj, exists, err := t.nodes.GetByKey(strings.TrimPrefix(key, "node/"))
+	if err != nil || !exists {
+		return nil, gvr
+	}
+	return obj.(*core_v1.Node), gvr
+}
+
+// Desired returns the record of the cached node with key, or the aggregate record, none once the node is deleted
+func (t *NodeHandler) Desired(key string) ([]DNSEntry, error) {
+	if key == aggregateKey {
+		return allowed(key, t.aggregateEntries()), nil
+	}
+	obj, exists, err := t.nodes.GetByKey(strings.TrimPrefix(key, "node/"))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		klog.Infof("NodeHandler.Desired: %s deleted", key)
+		return nil, nil
+	}
+	entries, err := t.entries(obj.(*core_v1.Node))
+	return allowed(key, entries), err
+}
+
+// publishedEndpoints returns the records every cached Node publishes, & the aggregate record
+func (t *NodeHandler) publishedEndpoints() []*endpoint.Endpoint {
+	desired := []*endpoint.Endpoint{}
+	for _, obj := range t.nodes.List() {
+		n := obj.(*core_v1.Node)
+		if terminating(n) {
+			continue
+		}
+		// a template failure is reported by the sync of the node, it publishes nothing here either
+		entries, _ := t.entries(n)
+		desired = append(desired, toEndpoints("node/"+n.Name, entries)...)
+	}
+	desired = append(desired, toEndpoints(aggregateKey, t.aggregateEntries())...)
+	return desired
+}
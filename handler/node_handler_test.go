@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+	"text/template"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// testNode returns a node with the InternalIP & ExternalIP, either may be empty
+func testNode(name, internalIP, externalIP string, ready, unschedulable bool, nodeLabels map[string]string) *core_v1.Node {
+	n := &core_v1.Node{ ObjectMeta: meta_v1.ObjectMeta{ Name: name, Labels: nodeLabels } }
+	n.Spec.Unschedulable = unschedulable
+	if internalIP != "" {
+		n.Status.Addresses = append(n.Status.Addresses, core_v1.NodeAddress{ Type: core_v1.NodeInternalIP, Address: internalIP })
+	}
+	if externalIP != "" {
+		n.Status.Addresses = append(n.Status.Addresses, core_v1.NodeAddress{ Type: core_v1.NodeExternalIP, Address: externalIP })
+	}
+	status := core_v1.ConditionFalse
+	if ready {
+		status = core_v1.ConditionTrue
+	}
+	n.Status.Conditions = []core_v1.NodeCondition{ { Type: core_v1.NodeReady, Status: status } }
+	return n
+}
+
+func newTestNodeHandler(t *testing.T, externalIP bool, aggregateFQDN, selector string, nodes ...*core_v1.Node) *NodeHandler {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, n := range nodes {
+		if err := indexer.Add(n); err != nil {
+			t.Fatalf("adding %s: %v", n.Name, err)
+		}
+	}
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", selector, err)
+	}
+	return &NodeHandler{
+		nodes: indexer,
+		fqdnTemplate: template.Must(template.New("node-fqdn").Option("missingkey=error").Parse("{{.Name}}.nodes.internal")),
+		externalIP: externalIP,
+		aggregateFQDN: aggregateFQDN,
+		aggregateSelector: sel,
+	}
+}
+
+func entryStrings(entries []DNSEntry) []string {
+	s := []string{}
+	for _, e := range entries {
+		s = append(s, e.String())
+	}
+	return s
+}
+
+func TestNodeHandlerDesired(t *testing.T) {
+	deleted := testNode("deleted", "10.0.0.9", "", true, false, map[string]string{ "pool": "ingress" })
+	deleted.DeletionTimestamp = &meta_v1.Time{}
+	nodes := []*core_v1.Node{
+		testNode("ready", "10.0.0.1", "20.0.0.1", true, false, map[string]string{ "pool": "ingress" }),
+		testNode("notready", "10.0.0.2", "", false, false, map[string]string{ "pool": "ingress" }),
+		testNode("cordoned", "10.0.0.3", "", true, true, map[string]string{ "pool": "ingress" }),
+		testNode("system", "10.0.0.4", "", true, false, map[string]string{ "pool": "system" }),
+		testNode("dualstack", "10.0.0.5", "", true, false, map[string]string{ "pool": "ingress" }),
+		testNode("nointernal", "", "20.0.0.6", true, false, nil),
+		deleted,
+	}
+	nodes[4].Status.Addresses = append(nodes[4].Status.Addresses, core_v1.NodeAddress{ Type: core_v1.NodeInternalIP, Address: "fd00::5" })
+
+	tests := []struct {
+		name       string
+		externalIP bool
+		key        string
+		want       []string
+	}{
+		{ name: "ready node", key: "node/ready", want: []string{ "ready.nodes.internal A 10.0.0.1" } },
+		{ name: "with external IPs", externalIP: true, key: "node/ready", want: []string{ "ready.nodes.internal A 10.0.0.1;20.0.0.1" } },
+		{ name: "not ready node keeps its record", key: "node/notready", want: []string{ "notready.nodes.internal A 10.0.0.2" } },
+		{ name: "cordoned node", key: "node/cordoned", want: []string{} },
+		{ name: "dual-stack node", key: "node/dualstack", want: []string{ "dualstack.nodes.internal A 10.0.0.5" } },
+		{ name: "only an external IP, not published", key: "node/nointernal", want: []string{} },
+		{ name: "deleted node", key: "node/gone", want: []string{} },
+		{ name: "aggregate of ready, schedulable nodes in the pool, not being deleted", key: aggregateKey, want: []string{ "ingress.nodes.internal A 10.0.0.1;10.0.0.5" } },
+		{ name: "aggregate with external IPs", externalIP: true, key: aggregateKey, want: []string{ "ingress.nodes.internal A 10.0.0.1;10.0.0.5;20.0.0.1" } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestNodeHandler(t, tt.externalIP, "ingress.nodes.internal", "pool=ingress", nodes...)
+			entries, err := h.Desired(tt.key)
+			if err != nil {
+				t.Fatalf("Desired(%s): %v", tt.key, err)
+			}
+			if got := entryStrings(entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Desired(%s) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeHandlerTemplateError(t *testing.T) {
+	h := newTestNodeHandler(t, false, "", "",
+		testNode("labelled", "10.0.0.1", "", true, false, map[string]string{ "zone": "1" }),
+		testNode("unlabelled", "10.0.0.2", "", true, false, nil))
+	h.fqdnTemplate = template.Must(template.New("node-fqdn").Option("missingkey=error").Parse("{{.Name}}.{{.Labels.zone}}.nodes.internal"))
+
+	entries, err := h.Desired("node/labelled")
+	if err != nil {
+		t.Fatalf("Desired(node/labelled): %v", err)
+	}
+	if got, want := entryStrings(entries), []string{ "labelled.1.nodes.internal A 10.0.0.1" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("Desired(node/labelled) = %v, want %v", got, want)
+	}
+
+	entries, err = h.Desired("node/unlabelled")
+	if _, ok := err.(*TemplateError); !ok {
+		t.Fatalf("Desired(node/unlabelled) error = %v, want a *TemplateError", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Desired(node/unlabelled) = %v, want none", entryStrings(entries))
+	}
+}
+
+func TestNodeHandlerAggregateEmpty(t *testing.T) {
+	tests := []struct {
+		name     string
+		fqdn     string
+		selector string
+	}{
+		{ name: "no aggregate record", fqdn: "", selector: "" },
+		{ name: "no ready node matches", fqdn: "ingress.nodes.internal", selector: "pool=missing" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestNodeHandler(t, false, tt.fqdn, tt.selector,
+				testNode("ready", "10.0.0.1", "", true, false, map[string]string{ "pool": "ingress" }),
+				testNode("notready", "10.0.0.2", "", false, false, map[string]string{ "pool": "missing" }))
+			if got := h.aggregateEntries(); len(got) != 0 {
+				t.Errorf("aggregateEntries = %v, want none", entryStrings(got))
+			}
+		})
+	}
+}
+
+func TestNodeHandlerKeys(t *testing.T) {
+	n := testNode("ready", "10.0.0.1", "", true, false, nil)
+	if got, want := newTestNodeHandler(t, false, "", "").Keys(n), []string{ "node/ready" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys = %v, want %v", got, want)
+	}
+	if got, want := newTestNodeHandler(t, false, "ingress.nodes.internal", "").Keys(n), []string{ "node/ready", aggregateKey }; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys with an aggregate record = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"sync"
+
+	"k8s.io/klog/v2"
+	"private-dns/endpoint"
+	"private-dns/metrics"
+	"private-dns/plan"
+)
+
+var (
+	policyMu sync.RWMutex
+	// policy limits the changes made from events, reconciliation passes its own policies
+	policy plan.Policy = &plan.SyncPolicy{}
+)
+
+// SetPolicy sets the policy applied to the changes made from events, eg plan.Policies["upsert-only"]
+func SetPolicy(p plan.Policy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = p
+}
+
+func currentPolicy() plan.Policy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policy
+}
+
+// applyPolicies returns changes limited by the policies, each change they drop is logged & counted
+func applyPolicies(changes *plan.Changes, policies []plan.Policy) *plan.Changes {
+	limited, skips := limitChanges(changes, policies)
+	for _, s := range skips {
+		s.report()
+	}
+	return limited
+}
+
+// applyReconcilePolicies is applyPolicies for a reconciliation, which plans the same dropped changes every period,
+// so a change is only logged & counted when the previous reconciliation did not drop it too
+func applyReconcilePolicies(changes *plan.Changes, policies []plan.Policy) *plan.Changes {
+	limited, skips := limitChanges(changes, policies)
+	for _, s := range reconcileSkips.changed(skips) {
+		s.report()
+	}
+	return limited
+}
+
+// limitChanges returns changes limited by the policies, & the changes they drop
+func limitChanges(changes *plan.Changes, policies []plan.Policy) (*plan.Changes, []skip) {
+	limited := changes
+	for _, p := range policies {
+		limited = p.Apply(limited)
+	}
+
+	skips := skipped("create", changes.Create, limited.Create)
+	skips = append(skips, skipped("update", changes.UpdateNew, limited.UpdateNew)...)
+	skips = append(skips, skipped("delete", changes.Delete, limited.Delete)...)
+	return limited, skips
+}
+
+// skip is a change to ep the policies dropped
+type skip struct {
+	action string
+	ep     *endpoint.Endpoint
+}
+
+// key identifies the change by action, name & type, the targets of a change skipped again may differ
+func (s skip) key() string {
+	return s.action + " " + recordKey(s.ep)
+}
+
+func (s skip) report() {
+	klog.Infof("Policy: skipping %s of %s, the policy does not allow it", s.action, s.ep)
+	metrics.SkippedByPolicy(s.action)
+}
+
+// skipped returns the endpoints in before that the policies dropped from after
+func skipped(action string, before, after []*endpoint.Endpoint) []skip {
+	kept := map[*endpoint.Endpoint]bool{}
+	for _, ep := range after {
+		kept[ep] = true
+	}
+	skips := []skip{}
+	for _, ep := range before {
+		if !kept[ep] {
+			skips = append(skips, skip{ action: action, ep: ep })
+		}
+	}
+	return skips
+}
+
+// skipSet is the changes the last reconciliation dropped
+type skipSet struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+var reconcileSkips = &skipSet{ keys: map[string]bool{} }
+
+// changed returns the skips the last reconciliation did not have, & keeps skips for the next one, so a change
+// allowed again & later dropped again is reported again
+func (s *skipSet) changed(skips []skip) []skip {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := map[string]bool{}
+	out := []skip{}
+	for _, sk := range skips {
+		if !s.keys[sk.key()] && !keys[sk.key()] {
+			out = append(out, sk)
+		}
+		keys[sk.key()] = true
+	}
+	s.keys = keys
+	return out
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"testing"
+
+	"private-dns/endpoint"
+	"private-dns/plan"
+)
+
+func TestApplyPolicies(t *testing.T) {
+	changes := func() *plan.Changes {
+		return &plan.Changes{
+			Create: []*endpoint.Endpoint{ record("new.corp.internal", "", "10.0.0.1") },
+			UpdateOld: []*endpoint.Endpoint{ record("app.corp.internal", "", "10.0.0.1") },
+			UpdateNew: []*endpoint.Endpoint{ record("app.corp.internal", "", "10.0.0.2") },
+			Delete: []*endpoint.Endpoint{ record("old.corp.internal", "", "10.0.0.1") },
+		}
+	}
+	tests := []struct {
+		name     string
+		policies []plan.Policy
+		create   int
+		update   int
+		delete   int
+	}{
+		{ name: "no policy", create: 1, update: 1, delete: 1 },
+		{ name: "sync", policies: []plan.Policy{ plan.Policies["sync"] }, create: 1, update: 1, delete: 1 },
+		{ name: "upsert-only", policies: []plan.Policy{ plan.Policies["upsert-only"] }, create: 1, update: 1 },
+		{ name: "create-only", policies: []plan.Policy{ plan.Policies["create-only"] }, create: 1 },
+		{ name: "upsert-only then create-only", policies: []plan.Policy{ plan.Policies["upsert-only"], plan.Policies["create-only"] }, create: 1 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := changes()
+			limited := applyPolicies(c, tt.policies)
+			if len(limited.Create) != tt.create || len(limited.UpdateNew) != tt.update || len(limited.Delete) != tt.delete {
+				t.Errorf("applyPolicies = %d creates, %d updates, %d deletes, want %d, %d, %d",
+					len(limited.Create), len(limited.UpdateNew), len(limited.Delete), tt.create, tt.update, tt.delete)
+			}
+			if len(c.Create) != 1 || len(c.UpdateNew) != 1 || len(c.Delete) != 1 {
+				t.Errorf("applyPolicies changed its input")
+			}
+		})
+	}
+}
+
+func TestReconcileSkips(t *testing.T) {
+	skips := func(keys ...string) []skip {
+		s := []skip{}
+		for _, k := range keys {
+			s = append(s, skip{ action: "delete", ep: record(k, "", "10.0.0.1") })
+		}
+		return s
+	}
+	reported := func(s []skip) []string {
+		n := []string{}
+		for _, sk := range s {
+			n = append(n, sk.ep.DNSName)
+		}
+		return sorted(n)
+	}
+
+	set := &skipSet{ keys: map[string]bool{} }
+	steps := []struct {
+		name  string
+		skips []skip
+		want  []string
+	}{
+		{ name: "first reconciliation", skips: skips("old.corp.internal", "stale.corp.internal"), want: []string{ "old.corp.internal", "stale.corp.internal" } },
+		{ name: "same skips again", skips: skips("stale.corp.internal", "old.corp.internal"), want: []string{} },
+		{ name: "a new skip", skips: skips("old.corp.internal", "stale.corp.internal", "gone.corp.internal"), want: []string{ "gone.corp.internal" } },
+		{ name: "a name matched without case or trailing dot", skips: skips("Old.Corp.Internal.", "stale.corp.internal", "gone.corp.internal"), want: []string{} },
+		{ name: "a skip left out", skips: skips("old.corp.internal", "gone.corp.internal"), want: []string{} },
+		{ name: "and skipped again", skips: skips("old.corp.internal", "gone.corp.internal", "stale.corp.internal"), want: []string{ "stale.corp.internal" } },
+		{ name: "the same change twice in one plan", skips: skips("new.corp.internal", "new.corp.internal"), want: []string{ "new.corp.internal" } },
+	}
+	for _, s := range steps {
+		if got := reported(set.changed(s.skips)); !sameNames(got, s.want) {
+			t.Errorf("%s: reported %v, want %v", s.name, got, s.want)
+		}
+	}
+
+	other := []skip{ { action: "update", ep: record("new.corp.internal", "", "10.0.0.2") } }
+	if got := set.changed(other); len(got) != 1 {
+		t.Errorf("update of a name whose delete was skipped: reported %d skips, want 1", len(got))
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"sync"
+)
+
+// Published tracks the entries last applied for each workqueue key, so the changes for a key
+// can be worked out from the latest state of its object when the key is processed
+type Published struct {
+	mu      sync.Mutex
+	entries map[string][]DNSEntry
+}
+
+// NewPublished returns an empty Published, after a restart every key's entries are created again
+func NewPublished() *Published {
+	return &Published{ entries: map[string][]DNSEntry{} }
+}
+
+// Changes returns the changes that move key from its published entries to desired. A name that
+// another key still publishes is not deleted, so objects sharing a hostname don't remove each other's record
+func (p *Published) Changes(key string, desired []DNSEntry) []HashableDNSChanges {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changes := []HashableDNSChanges{}
+	for _, c := range diffEntries(p.entries[key], desired) {
+		if c.new == (DNSEntry{}) && p.sharedLocked(key, c.old.fqdn) {
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// Seed records entries as published for key if nothing is, so the records an object published before a restart
+// can still be deleted when it is deleted
+func (p *Published) Seed(key string, entries []DNSEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.entries[key]; !ok && len(entries) > 0 {
+		p.entries[key] = entries
+	}
+}
+
+// Set records desired as published for key, once its changes have been applied
+func (p *Published) Set(key string, desired []DNSEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(desired) == 0 {
+		delete(p.entries, key)
+		return
+	}
+	p.entries[key] = desired
+}
+
+func (p *Published) sharedLocked(key, fqdn string) bool {
+	for k, entries := range p.entries {
+		if k == key {
+			continue
+		}
+		for _, e := range entries {
+			if e.fqdn == fqdn {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// changeStrings returns "create|update|delete fqdn targets ttl" for each change, in order
+func changeStrings(changes []HashableDNSChanges) []string {
+	s := []string{}
+	for _, c := range changes {
+		switch {
+		case c.old == (DNSEntry{}):
+			s = append(s, fmt.Sprintf("create %s %s %d", c.new.fqdn, c.new.targets, c.new.ttl))
+		case c.new == (DNSEntry{}):
+			s = append(s, fmt.Sprintf("delete %s %s %d", c.old.fqdn, c.old.targets, c.old.ttl))
+		default:
+			s = append(s, fmt.Sprintf("update %s %s %d", c.new.fqdn, c.new.targets, c.new.ttl))
+		}
+	}
+	return s
+}
+
+func TestDiffEntries(t *testing.T) {
+	app := NewDNSEntry("app.corp.internal", "A", 300, "10.0.0.1")
+	api := NewDNSEntry("api.corp.internal", "A", 300, "10.0.0.1")
+	web := NewDNSEntry("web.corp.internal", "A", 300, "10.0.0.1")
+
+	tests := []struct {
+		name     string
+		old, new []DNSEntry
+		want     []string
+	}{
+		{ name: "nothing published", new: []DNSEntry{ app, api }, want: []string{ "create app.corp.internal 10.0.0.1 300", "create api.corp.internal 10.0.0.1 300" } },
+		{ name: "unchanged", old: []DNSEntry{ app, api }, new: []DNSEntry{ api, app }, want: []string{} },
+		{ name: "one name removed from the list", old: []DNSEntry{ app, api, web }, new: []DNSEntry{ app, web }, want: []string{ "delete api.corp.internal 10.0.0.1 300" } },
+		{ name: "one name replaced", old: []DNSEntry{ app, api }, new: []DNSEntry{ app, web }, want: []string{ "create web.corp.internal 10.0.0.1 300", "delete api.corp.internal 10.0.0.1 300" } },
+		{ name: "targets changed", old: []DNSEntry{ app }, new: []DNSEntry{ NewDNSEntry("app.corp.internal", "A", 300, "10.0.0.2") }, want: []string{ "update app.corp.internal 10.0.0.2 300" } },
+		{ name: "TTL-only updates in the order of the new records, before the deletes",
+			old: []DNSEntry{ web, app, api },
+			new: []DNSEntry{ NewDNSEntry("app.corp.internal", "A", 600, "10.0.0.1"), NewDNSEntry("api.corp.internal", "A", 60, "10.0.0.1") },
+			want: []string{ "update app.corp.internal 10.0.0.1 600", "update api.corp.internal 10.0.0.1 60", "delete web.corp.internal 10.0.0.1 300" } },
+		{ name: "every name removed", old: []DNSEntry{ app, api }, want: []string{ "delete app.corp.internal 10.0.0.1 300", "delete api.corp.internal 10.0.0.1 300" } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changeStrings(diffEntries(tt.old, tt.new)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffEntries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishedChanges(t *testing.T) {
+	shared := NewDNSEntry("shared.corp.internal", "A", 300, "10.0.0.1")
+	app := NewDNSEntry("app.corp.internal", "A", 300, "10.0.0.1")
+	api := NewDNSEntry("api.corp.internal", "A", 300, "10.0.0.2")
+
+	p := NewPublished()
+	p.Set("default/app", []DNSEntry{ shared, app })
+	p.Set("default/api", []DNSEntry{ shared, api })
+
+	if got, want := changeStrings(p.Changes("default/app", []DNSEntry{ shared })), []string{ "delete app.corp.internal 10.0.0.1 300" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("removing one name: Changes = %v, want %v", got, want)
+	}
+	if got, want := changeStrings(p.Changes("default/app", nil)), []string{ "delete app.corp.internal 10.0.0.1 300" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleting an object sharing a name: Changes = %v, want %v", got, want)
+	}
+	p.Set("default/app", nil)
+	if got, want := changeStrings(p.Changes("default/api", nil)), []string{ "delete shared.corp.internal 10.0.0.1 300", "delete api.corp.internal 10.0.0.2 300" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleting the last object with a name: Changes = %v, want %v", got, want)
+	}
+
+	p.Seed("default/api", []DNSEntry{ app })
+	if got, want := changeStrings(p.Changes("default/api", nil)), []string{ "delete shared.corp.internal 10.0.0.1 300", "delete api.corp.internal 10.0.0.2 300" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("Seed replaced the published records: Changes = %v, want %v", got, want)
+	}
+	p.Seed("default/web", []DNSEntry{ app })
+	if got, want := changeStrings(p.Changes("default/web", nil)), []string{ "delete app.corp.internal 10.0.0.1 300" }; !reflect.DeepEqual(got, want) {
+		t.Errorf("seeded key: Changes = %v, want %v", got, want)
+	}
+}
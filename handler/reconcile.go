@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"private-dns/endpoint"
+	"private-dns/plan"
+	"private-dns/provider"
+)
+
+var (
+	ownerMu sync.RWMutex
+	// ownerID labels the records published by this controller, so reconciliation
+	// never touches records created by hand or by another cluster
+	ownerID = "private-dns"
+)
+
+// SetOwnerID sets the owner label written to every record this controller publishes
+func SetOwnerID(id string) {
+	ownerMu.Lock()
+	defer ownerMu.Unlock()
+	ownerID = id
+}
+
+func currentOwnerID() string {
+	ownerMu.RLock()
+	defer ownerMu.RUnlock()
+	return ownerID
+}
+
+// endpoint returns the entry as an Endpoint labelled with our owner, and the resource if known
+func (e DNSEntry) endpoint(resource string) *endpoint.Endpoint {
+	ep := endpoint.NewEndpointWithTTL(e.fqdn, e.recordtype, endpoint.TTL(e.ttl), e.targetList()...)
+	ep.Labels[endpoint.OwnerLabelKey] = currentOwnerID()
+	if resource != "" {
+		ep.Labels[endpoint.ResourceLabelKey] = resource
+	}
+	return ep
+}
+
+// terminating returns true for an object being deleted, it publishes no records while it waits on its finalizers
+func terminating(obj meta_v1.Object) bool {
+	return obj.GetDeletionTimestamp() != nil
+}
+
+// allowed returns the entries of key whose names the domain filter lets the controller manage
+func allowed(key string, entries []DNSEntry) []DNSEntry {
+	filtered := []DNSEntry{}
+	for _, e := range entries {
+		if !provider.MatchDomain(e.fqdn) {
+			klog.Infof("%s: skipping %s, it is outside the domain filter", key, e.fqdn)
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+	return filtered
+}
+
+// toEndpoints returns the entries published for resource (eg 'service/default/app1') as Endpoints
+func toEndpoints(resource string, entries []DNSEntry) []*endpoint.Endpoint {
+	endpoints := []*endpoint.Endpoint{}
+	for _, e := range allowed(resource, entries) {
+		endpoints = append(endpoints, e.endpoint(resource))
+	}
+	return endpoints
+}
+
+// ownedRecords returns the records in the provider's zones labelled with our owner, and every record
+func ownedRecords(ctx context.Context, p provider.Provider) (owned []*endpoint.Endpoint, all []*endpoint.Endpoint, err error) {
+	all, err = p.Records(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owner := currentOwnerID()
+	owned = []*endpoint.Endpoint{}
+	for _, r := range all {
+		if r.Labels[endpoint.OwnerLabelKey] == owner {
+			owned = append(owned, r)
+		}
+	}
+	return owned, all, nil
+}
+
+// planChanges compares the desired endpoints with the records we own in the provider's zones,
+// and returns the changes the plan calculates under the policies
+func planChanges(ctx context.Context, p provider.Provider, desired []*endpoint.Endpoint, policies []plan.Policy) (*plan.Changes, error) {
+	current, all, err := ownedRecords(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	changes := (&plan.Plan{ Current: current, Desired: desired }).Calculate().Changes
+	changes.Create = notForeign(changes.Create, all)
+	return applyReconcilePolicies(changes, policies), nil
+}
+
+// notForeign drops the creates whose name holds a record we do not own, the provider would overwrite a record
+// created by hand or by another owner & take it over
+func notForeign(creates []*endpoint.Endpoint, all []*endpoint.Endpoint) []*endpoint.Endpoint {
+	owner := currentOwnerID()
+	foreign := map[string]string{}
+	for _, r := range all {
+		if o := r.Labels[endpoint.OwnerLabelKey]; o != owner {
+			foreign[strings.ToLower(strings.TrimSuffix(r.DNSName, "."))] = o
+		}
+	}
+
+	kept := []*endpoint.Endpoint{}
+	for _, ep := range creates {
+		if o, ok := foreign[strings.ToLower(strings.TrimSuffix(ep.DNSName, "."))]; ok {
+			if o == "" {
+				o = "none, created by hand"
+			}
+			klog.Infof("planChanges: skipping create of %s, the name holds a record of another owner (%s)", ep, o)
+			continue
+		}
+		kept = append(kept, ep)
+	}
+	return kept
+}
+
+// NoChanges returns true when changes would not create, update or delete any record
+func NoChanges(changes *plan.Changes) bool {
+	return len(changes.Create) == 0 && len(changes.UpdateNew) == 0 && len(changes.Delete) == 0
+}
+
+// reconcile applies the changes planned by a reconciliation
+func reconcile(ctx context.Context, p provider.Provider, changes *plan.Changes) error {
+	if NoChanges(changes) {
+		klog.Info("reconcile: records are in sync")
+		return nil
+	}
+
+	klog.Infof("reconcile: create %v, update %v, delete %v", changes.Create, changes.UpdateNew, changes.Delete)
+	return p.ApplyChanges(ctx, changes)
+}
+
+// recordKey identifies a record set, a zone holds one per name & type
+func recordKey(ep *endpoint.Endpoint) string {
+	return strings.ToLower(strings.TrimSuffix(ep.DNSName, ".")) + " " + ep.RecordType
+}
+
+// applyPlan applies changes saved from an earlier plan, it fails without changing anything if a record the plan
+// updates or deletes no longer matches, or a record it creates now exists
+func applyPlan(ctx context.Context, p provider.Provider, changes *plan.Changes) error {
+	if NoChanges(changes) {
+		klog.Info("applyPlan: nothing to apply")
+		return nil
+	}
+
+	owned, all, err := ownedRecords(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	current := map[string]*endpoint.Endpoint{}
+	for _, r := range owned {
+		current[recordKey(r)] = r
+	}
+	for _, ep := range append(append([]*endpoint.Endpoint{}, changes.UpdateOld...), changes.Delete...) {
+		r, ok := current[recordKey(ep)]
+		if !ok || r.RecordTTL != ep.RecordTTL || !r.Targets.Same(ep.Targets) {
+			return fmt.Errorf("plan is stale, %s has changed since it was planned", ep.DNSName)
+		}
+	}
+
+	exists := map[string]bool{}
+	for _, r := range all {
+		exists[recordKey(r)] = true
+	}
+	for _, ep := range changes.Create {
+		if exists[recordKey(ep)] {
+			return fmt.Errorf("plan is stale, %s has been created since it was planned", ep.DNSName)
+		}
+	}
+
+	klog.Infof("applyPlan: create %v, update %v, delete %v", changes.Create, changes.UpdateNew, changes.Delete)
+	return p.ApplyChanges(ctx, changes)
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"private-dns/endpoint"
+	"private-dns/plan"
+)
+
+// fakeProvider serves fixed records & saves the changes applied
+type fakeProvider struct {
+	records []*endpoint.Endpoint
+	applied *plan.Changes
+}
+
+func (p *fakeProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return p.records, nil
+}
+
+func (p *fakeProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	p.applied = changes
+	return nil
+}
+
+func (p *fakeProvider) Ping(ctx context.Context) error {
+	return nil
+}
+
+// record returns an A record labelled with owner, none when owner is empty
+func record(name, owner string, targets ...string) *endpoint.Endpoint {
+	ep := endpoint.NewEndpointWithTTL(name, endpoint.RecordTypeA, endpoint.TTL(300), targets...)
+	if owner != "" {
+		ep.Labels[endpoint.OwnerLabelKey] = owner
+	}
+	return ep
+}
+
+func names(endpoints []*endpoint.Endpoint) []string {
+	n := []string{}
+	for _, ep := range endpoints {
+		n = append(n, ep.DNSName)
+	}
+	sort.Strings(n)
+	return n
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sorted(s []string) []string {
+	s = append([]string{}, s...)
+	sort.Strings(s)
+	return s
+}
+
+func TestPlanChanges(t *testing.T) {
+	owner := currentOwnerID()
+	tests := []struct {
+		name     string
+		records  []*endpoint.Endpoint
+		desired  []*endpoint.Endpoint
+		policies []plan.Policy
+		create   []string
+		update   []string
+		delete   []string
+	}{
+		{
+			name: "create missing record",
+			desired: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1") },
+			create: []string{ "app.corp.internal" },
+		},
+		{
+			name: "in sync",
+			records: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1") },
+			desired: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1") },
+		},
+		{
+			name: "update changed target",
+			records: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1") },
+			desired: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.2") },
+			update: []string{ "app.corp.internal" },
+		},
+		{
+			name: "delete owned record no longer desired",
+			records: []*endpoint.Endpoint{ record("old.corp.internal", owner, "10.0.0.1") },
+			delete: []string{ "old.corp.internal" },
+		},
+		{
+			name: "records of another owner are not deleted",
+			records: []*endpoint.Endpoint{ record("other.corp.internal", "other-cluster", "10.0.0.1"), record("manual.corp.internal", "", "10.0.0.2") },
+		},
+		{
+			name: "create at name of another owner is skipped",
+			records: []*endpoint.Endpoint{ record("app.corp.internal", "other-cluster", "10.0.0.1") },
+			desired: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.2") },
+		},
+		{
+			name: "create at name created by hand is skipped",
+			records: []*endpoint.Endpoint{ record("App.Corp.Internal.", "", "10.0.0.1") },
+			desired: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.2"), record("web.corp.internal", owner, "10.0.0.3") },
+			create: []string{ "web.corp.internal" },
+		},
+		{
+			name: "upsert-only keeps records",
+			records: []*endpoint.Endpoint{ record("old.corp.internal", owner, "10.0.0.1"), record("app.corp.internal", owner, "10.0.0.1") },
+			desired: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.2"), record("new.corp.internal", owner, "10.0.0.3") },
+			policies: []plan.Policy{ plan.Policies["upsert-only"] },
+			create: []string{ "new.corp.internal" },
+			update: []string{ "app.corp.internal" },
+		},
+		{
+			name: "create-only",
+			records: []*endpoint.Endpoint{ record("old.corp.internal", owner, "10.0.0.1"), record("app.corp.internal", owner, "10.0.0.1") },
+			desired: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.2"), record("new.corp.internal", owner, "10.0.0.3") },
+			policies: []plan.Policy{ plan.Policies["create-only"] },
+			create: []string{ "new.corp.internal" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProvider{ records: tt.records }
+			changes, err := planChanges(context.Background(), p, tt.desired, tt.policies)
+			if err != nil {
+				t.Fatalf("planChanges: %v", err)
+			}
+			if got := names(changes.Create); !sameNames(got, sorted(tt.create)) {
+				t.Errorf("Create = %v, want %v", got, tt.create)
+			}
+			if got := names(changes.UpdateNew); !sameNames(got, sorted(tt.update)) {
+				t.Errorf("UpdateNew = %v, want %v", got, tt.update)
+			}
+			if got := names(changes.Delete); !sameNames(got, sorted(tt.delete)) {
+				t.Errorf("Delete = %v, want %v", got, tt.delete)
+			}
+		})
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	owner := currentOwnerID()
+	withTTL := func(ep *endpoint.Endpoint, ttl endpoint.TTL) *endpoint.Endpoint {
+		ep.RecordTTL = ttl
+		return ep
+	}
+	cname := endpoint.NewEndpointWithTTL("app.corp.internal", endpoint.RecordTypeCNAME, endpoint.TTL(300), "lb.corp.internal")
+
+	tests := []struct {
+		name    string
+		records []*endpoint.Endpoint
+		changes *plan.Changes
+		stale   bool
+	}{
+		{ name: "nothing to apply", changes: &plan.Changes{} },
+		{ name: "records unchanged since the plan",
+			records: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1"), record("old.corp.internal", owner, "10.0.0.9") },
+			changes: &plan.Changes{
+				Create:    []*endpoint.Endpoint{ record("new.corp.internal", owner, "10.0.0.5") },
+				UpdateOld: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1") },
+				UpdateNew: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.2") },
+				Delete:    []*endpoint.Endpoint{ record("old.corp.internal", owner, "10.0.0.9") },
+			} },
+		{ name: "names matched without case or trailing dots",
+			records: []*endpoint.Endpoint{ record("App.Corp.Internal.", owner, "10.0.0.1") },
+			changes: &plan.Changes{ Delete: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1") } } },
+		{ name: "updated record whose targets changed",
+			records: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.3") },
+			changes: &plan.Changes{
+				UpdateOld: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.1") },
+				UpdateNew: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.2") },
+			}, stale: true },
+		{ name: "deleted record whose TTL changed",
+			records: []*endpoint.Endpoint{ withTTL(record("old.corp.internal", owner, "10.0.0.9"), 60) },
+			changes: &plan.Changes{ Delete: []*endpoint.Endpoint{ record("old.corp.internal", owner, "10.0.0.9") } }, stale: true },
+		{ name: "deleted record already gone",
+			changes: &plan.Changes{ Delete: []*endpoint.Endpoint{ record("old.corp.internal", owner, "10.0.0.9") } }, stale: true },
+		{ name: "deleted record taken over by another owner",
+			records: []*endpoint.Endpoint{ record("old.corp.internal", "other", "10.0.0.9") },
+			changes: &plan.Changes{ Delete: []*endpoint.Endpoint{ record("old.corp.internal", owner, "10.0.0.9") } }, stale: true },
+		{ name: "created record now exists",
+			records: []*endpoint.Endpoint{ record("new.corp.internal", "", "10.0.0.7") },
+			changes: &plan.Changes{ Create: []*endpoint.Endpoint{ record("new.corp.internal", owner, "10.0.0.5") } }, stale: true },
+		{ name: "created record beside another type of the name",
+			records: []*endpoint.Endpoint{ cname },
+			changes: &plan.Changes{ Create: []*endpoint.Endpoint{ record("app.corp.internal", owner, "10.0.0.5") } } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProvider{ records: tt.records }
+			err := applyPlan(context.Background(), p, tt.changes)
+			switch {
+			case tt.stale:
+				if err == nil || !strings.Contains(err.Error(), "plan is stale") {
+					t.Fatalf("applyPlan = %v, want a stale plan error", err)
+				}
+				if p.applied != nil {
+					t.Errorf("applyPlan applied %+v to a stale plan, want nothing", p.applied)
+				}
+			case err != nil:
+				t.Fatalf("applyPlan: %v", err)
+			case NoChanges(tt.changes):
+				if p.applied != nil {
+					t.Errorf("applyPlan applied %+v, want nothing", p.applied)
+				}
+			case p.applied != tt.changes:
+				t.Errorf("applyPlan applied %+v, want the plan", p.applied)
+			}
+		})
+	}
+}
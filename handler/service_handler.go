@@ -4,111 +4,230 @@ import (
 	"k8s.io/klog/v2"
 	"private-dns/endpoint"
 
-	"context"
+	"text/template"
 
 	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
 	"private-dns/provider"
 
 )
 
+// EndpointSliceResource are the EndpointSlices watched for the addresses of headless Services, when the cluster serves them
+var EndpointSliceResource = schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"}
+
+// serviceNameLabel names the Service of an EndpointSlice
+const serviceNameLabel = "kubernetes.io/service-name"
+
+// byService indexes the Endpoints & EndpointSlices by the namespace/name of their Service
+const byService = "service"
 
 // DNSHandler is a sample implementation of Handler
 type DNSHandler struct{
-	Provider provider.Provider
+	zoneHandler
+	services  cache.Indexer
+	// endpoints holds the Endpoints, or the EndpointSlices, of the Services
+	endpoints cache.Indexer
+	// fqdnTemplate names internal LoadBalancer Services without a fqdn annotation, nil to skip them
+	fqdnTemplate *template.Template
 }
 
-// NewDNSHandler returns a Handler.
-func NewDNSHandler(inCluster bool, resourceGroup string, subID string) (*DNSHandler, error)  {
+// NewDNSHandler returns a Handler, the endpoints informer supplies the addresses of headless Services, it watches
+// either the Endpoints or the EndpointSlices (EndpointSliceResource) & must not have been started.
+func NewDNSHandler(azureAuth provider.AzureAuth, resourceGroup string, subID string, fqdnTemplate *template.Template, services, endpoints cache.SharedIndexInformer) (*DNSHandler, error)  {
 	
-	klog.Info("NewIngressHandler - Creating Azure Private Provider")
+	klog.Info("NewDNSHandler - Creating Azure Private Provider")
+
+	if err := endpoints.AddIndexers(cache.Indexers{ byService: func(obj interface{}) ([]string, error) { return endpointsService(obj), nil } }); err != nil {
+		return nil, err
+	}
 
-	p, err := provider.NewAzurePrivateProvider(inCluster, resourceGroup, subID)
+	p, err := provider.NewAzurePrivateProvider(azureAuth, resourceGroup, subID)
 	if err != nil {
 		klog.Fatalf("failed to create NewAzureProvider: %v", err)
 		return nil, err
 	}
 
-	return &DNSHandler{ Provider: p}, nil
+	h := &DNSHandler{ services: services.GetIndexer(), endpoints: endpoints.GetIndexer(), fqdnTemplate: fqdnTemplate}
+	h.zoneHandler = newZoneHandler("DNSHandler", p, h.publishedEndpoints)
+	return h, nil
 }
 
-// ObjectCreated is called when an object is created
-func (t *DNSHandler) ObjectCreated(obj interface{}) HashableDNSChanges {
-	klog.Info("DNSHandler.ObjectCreated")
-	// assert the type to a Service object to pull out relevant data
-	service := obj.(*core_v1.Service)
-	klog.Infof("    ResourceVersion: %s", service.ObjectMeta.ResourceVersion)
-	klog.Infof("    Service Type: %s", service.Spec.Type)
-	klog.Infof("    Status: %s", service.Status.LoadBalancer)
-
-	return HashableDNSChanges{}
+// endpointsService returns the namespace/name of the Service of an Endpoints or EndpointSlice, none for a slice without one
+func endpointsService(obj interface{}) []string {
+	switch ep := obj.(type) {
+	case *core_v1.Endpoints:
+		return []string{ ep.Namespace + "/" + ep.Name }
+	case *unstructured.Unstructured:
+		if name := ep.GetLabels()[serviceNameLabel]; name != "" {
+			return []string{ ep.GetNamespace() + "/" + name }
+		}
+	}
+	return nil
 }
 
-// ObjectDeleted is called when an object is deleted
-func (t *DNSHandler) ObjectDeleted(obj interface{}) HashableDNSChanges {
-	klog.Infof("DNSHandler.ObjectDeleted: %s", obj)
-	oldS := obj.(*core_v1.Service)
-	oldFQDN := oldS.Annotations["service.beta.kubernetes.io/azure-dns-zone-fqdn"]
-	oldIP :=  ""
-	if len(oldS.Status.LoadBalancer.Ingress)>0 { oldIP = oldS.Status.LoadBalancer.Ingress[0].IP }
-
-	if oldS.Annotations["service.beta.kubernetes.io/azure-load-balancer-internal"] == "true" && oldFQDN != "" && oldIP != "" {
-		return HashableDNSChanges{  old: DNSEntry{ fqdn: oldFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: oldIP} } 
+// readyAddresses returns the ready pod IPs of the Service namespace/name, from its Endpoints or EndpointSlices
+func (t *DNSHandler) readyAddresses(namespace, name string) []string {
+	objs, err := t.endpoints.ByIndex(byService, namespace+"/"+name)
+	if err != nil {
+		klog.Errorf("DNSHandler: cannot read the endpoints of %s/%s: %v", namespace, name, err)
+		return nil
 	}
-	return HashableDNSChanges{}
-
+	ips := []string{}
+	for _, obj := range objs {
+		switch ep := obj.(type) {
+		case *core_v1.Endpoints:
+			ips = append(ips, endpointsAddresses(ep)...)
+		case *unstructured.Unstructured:
+			ips = append(ips, sliceAddresses(ep)...)
+		}
+	}
+	return dedupe(ips)
 }
 
-// ObjectUpdated is called when an object is updated
-func (t *DNSHandler) ObjectUpdated(objOld, objNew interface{}) HashableDNSChanges {
-	klog.Info("DNSHandler.ObjectUpdated")
-	oldS := objOld.(*core_v1.Service)
-	newS := objNew.(*core_v1.Service)
-
-	oldFQDN := oldS.Annotations["service.beta.kubernetes.io/azure-dns-zone-fqdn"]
-	oldIP :=  ""
-	if len(oldS.Status.LoadBalancer.Ingress)>0 { oldIP = oldS.Status.LoadBalancer.Ingress[0].IP }
+func (t *DNSHandler) getService(namespace, name string) *core_v1.Service {
+	obj, exists, err := t.services.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*core_v1.Service)
+}
 
-	oldEntry := oldS.Annotations["service.beta.kubernetes.io/azure-load-balancer-internal"] == "true" && oldFQDN != "" && oldIP != ""
+// endpointsAddresses returns the ready pod IPs of the Endpoints, the not ready ones are kept apart in NotReadyAddresses
+func endpointsAddresses(ep *core_v1.Endpoints) []string {
+	ips := []string{}
+	for _, subset := range ep.Subsets {
+		for _, address := range subset.Addresses {
+			ips = append(ips, address.IP)
+		}
+	}
+	return ips
+}
 
-	newFQDN := newS.Annotations["service.beta.kubernetes.io/azure-dns-zone-fqdn"]
-	newIP := ""
-	if len(newS.Status.LoadBalancer.Ingress)>0 { newIP =  newS.Status.LoadBalancer.Ingress[0].IP }
+// sliceAddresses returns the ready pod IPs of the EndpointSlice, an endpoint without a ready condition is ready
+func sliceAddresses(slice *unstructured.Unstructured) []string {
+	ips := []string{}
+	if addressType, _, _ := unstructured.NestedString(slice.Object, "addressType"); addressType == "FQDN" {
+		return ips
+	}
+	endpoints, _, _ := unstructured.NestedSlice(slice.Object, "endpoints")
+	for _, e := range endpoints {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if ready, found, _ := unstructured.NestedBool(m, "conditions", "ready"); found && !ready {
+			continue
+		}
+		addresses, _, _ := unstructured.NestedStringSlice(m, "addresses")
+		ips = append(ips, addresses...)
+	}
+	return ips
+}
 
-	changes := HashableDNSChanges{}
+// entries returns the records for each name in the fqdn annotation of a Service:
+//  - internal LoadBalancer Services, an A record to the load balancer IP, or to the target annotation
+//  - ExternalName Services, a CNAME to spec.externalName
+//  - headless Services, an A record set of the ready addresses
+// internal LoadBalancer Services without the annotation are named by the fqdnTemplate, if one is set, with a *TemplateError if it fails
+func (t *DNSHandler) entries(s *core_v1.Service, addresses []string) ([]DNSEntry, error) {
+	fqdns := fqdnList(s.Annotations[FQDNAnnotation])
+	var err error
+	if len(fqdns) == 0 && s.Spec.Type != core_v1.ServiceTypeExternalName && s.Spec.ClusterIP != core_v1.ClusterIPNone && s.Annotations["service.beta.kubernetes.io/azure-load-balancer-internal"] == "true" {
+		if fqdns, err = templateFQDNs(t.fqdnTemplate, s, s.Namespace+"/"+s.Name); err != nil {
+			return nil, err
+		}
+	}
+	if len(fqdns) == 0 {
+		return nil, nil
+	}
+	ttl := recordTTL(s.Annotations, s.Namespace+"/"+s.Name)
 
-	klog.Infof("DNSHandler: Got Service, required fqdn=%s", newFQDN)
+	var entry func(fqdn string) []DNSEntry
+	switch {
+	case s.Spec.Type == core_v1.ServiceTypeExternalName:
+		if s.Spec.ExternalName == "" {
+			return nil, nil
+		}
+		entry = func(fqdn string) []DNSEntry {
+			return []DNSEntry{ { fqdn: fqdn, recordtype: endpoint.RecordTypeCNAME, ttl: ttl, targets: s.Spec.ExternalName } }
+		}
+	case s.Spec.ClusterIP == core_v1.ClusterIPNone:
+		if len(addresses) == 0 {
+			return nil, nil
+		}
+		entry = func(fqdn string) []DNSEntry { return newDNSEntries(fqdn, ttl, addresses...) }
+	default:
+		ip :=  ""
+		if len(s.Status.LoadBalancer.Ingress)>0 { ip = s.Status.LoadBalancer.Ingress[0].IP }
+
+		targets := []string{ ip }
+		if override, ok := targetOverride(s.Annotations, s.Namespace+"/"+s.Name); ok {
+			targets = override
+		}
 
-	if newS.Annotations["service.beta.kubernetes.io/azure-load-balancer-internal"] == "true" && newFQDN != "" && newIP != "" {
-		klog.Info("DNSHandler: Got internal updated Service with fqdn & IP")
-		if oldEntry {
-			if oldFQDN != newFQDN || oldIP != newIP {
-				changes.old = DNSEntry{ fqdn: oldFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: oldIP}
-				changes.new = DNSEntry{ fqdn: newFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: newIP}
-			}
-		} else {
-			changes.new = DNSEntry{ fqdn: newFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: newIP}
+		if s.Annotations["service.beta.kubernetes.io/azure-load-balancer-internal"] != "true" || targets[0] == "" {
+			return nil, nil
 		}
-	} else if (oldEntry) {
-		changes.old = DNSEntry{ fqdn: oldFQDN, recordtype: endpoint.RecordTypeA , ttl: 3600, ip: oldIP}
-	} 
+		entry = func(fqdn string) []DNSEntry { return newDNSEntries(fqdn, ttl, targets...) }
+	}
 
-	return changes
+	entries := []DNSEntry{}
+	for _, fqdn := range fqdns {
+		entries = append(entries, entry(fqdn)...)
+	}
+	return entries, nil
 }
 
+// Keys returns the key of the Service, an Endpoints object or EndpointSlice shares the key of its Service
+func (t *DNSHandler) Keys(obj interface{}) []string {
+	if _, ok := obj.(*core_v1.Service); !ok {
+		return endpointsService(obj)
+	}
+	s := obj.(*core_v1.Service)
+	return []string{ s.Namespace + "/" + s.Name }
+}
 
+// Object returns the cached Service with key
+func (t *DNSHandler) Object(key string) (meta_v1.Object, schema.GroupVersionResource) {
+	gvr := core_v1.SchemeGroupVersion.WithResource("services")
+	obj, exists, err := t.services.GetByKey(key)
+	if err != nil || !exists {
+		return nil, gvr
+	}
+	return obj.(*core_v1.Service), gvr
+}
 
-
-// ApplyChanges comment
-func (t *DNSHandler) ApplyChanges(changes HashableDNSChanges) error {
-
-	apply, applyIt :=HashDNSToPlan (changes)
-	
-	if applyIt {
-		klog.Info("DNSHandler: ApplyChanges")
-		return t.Provider.ApplyChanges(context.Background(), &apply)
+// Desired returns the records of the cached Service with key, none once it is deleted
+func (t *DNSHandler) Desired(key string) ([]DNSEntry, error) {
+	obj, exists, err := t.services.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		klog.Infof("DNSHandler.Desired: Service %s deleted", key)
+		return nil, nil
 	}
+	s := obj.(*core_v1.Service)
 
-	klog.Info("DNSHandler: Nothing Applied")
-	return nil
+	klog.Infof("DNSHandler: Got Service %s, required fqdn=%s", key, s.Annotations[FQDNAnnotation])
+	entries, err := t.entries(s, t.readyAddresses(s.Namespace, s.Name))
+	return allowed(key, entries), err
 }
 
+// publishedEndpoints returns the records every cached Service publishes
+func (t *DNSHandler) publishedEndpoints() []*endpoint.Endpoint {
+	desired := []*endpoint.Endpoint{}
+	for _, obj := range t.services.List() {
+		s := obj.(*core_v1.Service)
+		if terminating(s) {
+			continue
+		}
+		// a template failure is reported by the sync of the Service, it publishes nothing here either
+		entries, _ := t.entries(s, t.readyAddresses(s.Namespace, s.Name))
+		desired = append(desired, toEndpoints("service/"+s.Namespace+"/"+s.Name, entries)...)
+	}
+	return desired
+}
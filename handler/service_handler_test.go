@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// testService returns a Service in default with the annotations, of type ExternalName if externalName is set,
+// headless if clusterIP is None, otherwise a LoadBalancer with the lbIP, if any
+func testService(name string, annotations map[string]string, clusterIP, externalName, lbIP string) *core_v1.Service {
+	s := &core_v1.Service{ ObjectMeta: meta_v1.ObjectMeta{ Name: name, Namespace: "default", Annotations: annotations } }
+	s.Spec.ClusterIP = clusterIP
+	switch {
+	case externalName != "":
+		s.Spec.Type = core_v1.ServiceTypeExternalName
+		s.Spec.ExternalName = externalName
+	case clusterIP == core_v1.ClusterIPNone:
+		s.Spec.Type = core_v1.ServiceTypeClusterIP
+	default:
+		s.Spec.Type = core_v1.ServiceTypeLoadBalancer
+	}
+	if lbIP != "" {
+		s.Status.LoadBalancer.Ingress = []core_v1.LoadBalancerIngress{ { IP: lbIP } }
+	}
+	return s
+}
+
+// testSlice returns an EndpointSlice of the Service, each endpoint maps an address to its ready condition
+func testSlice(name, service, addressType string, endpoints map[string]bool) *unstructured.Unstructured {
+	eps := []interface{}{}
+	for address, ready := range endpoints {
+		eps = append(eps, map[string]interface{}{
+			"addresses":  []interface{}{ address },
+			"conditions": map[string]interface{}{ "ready": ready },
+		})
+	}
+	slice := &unstructured.Unstructured{ Object: map[string]interface{}{
+		"apiVersion":  "discovery.k8s.io/v1",
+		"kind":        "EndpointSlice",
+		"addressType": addressType,
+		"endpoints":   eps,
+	} }
+	slice.SetNamespace("default")
+	slice.SetName(name)
+	slice.SetLabels(map[string]string{ serviceNameLabel: service })
+	return slice
+}
+
+// testEndpoints returns the Endpoints of the Service with the ready & not ready addresses
+func testEndpoints(service string, ready, notReady []string) *core_v1.Endpoints {
+	subset := core_v1.EndpointSubset{}
+	for _, ip := range ready {
+		subset.Addresses = append(subset.Addresses, core_v1.EndpointAddress{ IP: ip })
+	}
+	for _, ip := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, core_v1.EndpointAddress{ IP: ip })
+	}
+	return &core_v1.Endpoints{ ObjectMeta: meta_v1.ObjectMeta{ Name: service, Namespace: "default" }, Subsets: []core_v1.EndpointSubset{ subset } }
+}
+
+// newTestDNSHandler returns a DNSHandler over indexers holding the Services & the Endpoints or EndpointSlices
+func newTestDNSHandler(t *testing.T, services []*core_v1.Service, endpoints ...interface{}) *DNSHandler {
+	serviceIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, s := range services {
+		if err := serviceIndexer.Add(s); err != nil {
+			t.Fatalf("adding %s: %v", s.Name, err)
+		}
+	}
+	endpointIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{ byService: func(obj interface{}) ([]string, error) { return endpointsService(obj), nil } })
+	for _, ep := range endpoints {
+		if err := endpointIndexer.Add(ep); err != nil {
+			t.Fatalf("adding %v: %v", ep, err)
+		}
+	}
+	return &DNSHandler{ services: serviceIndexer, endpoints: endpointIndexer }
+}
+
+// desiredStrings returns the records the handler wants for key, failing the test on an error
+func desiredStrings(t *testing.T, h *DNSHandler, key string) []string {
+	entries, err := h.Desired(key)
+	if err != nil {
+		t.Fatalf("Desired(%s): %v", key, err)
+	}
+	return entryStrings(entries)
+}
+
+func TestDNSHandlerHeadless(t *testing.T) {
+	fqdn := map[string]string{ FQDNAnnotation: "db.corp.internal" }
+	tests := []struct {
+		name      string
+		endpoints []interface{}
+		want      []string
+	}{
+		{ name: "ready addresses of the EndpointSlices", endpoints: []interface{}{
+			testSlice("db-a", "db", "IPv4", map[string]bool{ "10.1.0.2": true, "10.1.0.1": true }),
+			testSlice("db-b", "db", "IPv4", map[string]bool{ "10.1.0.3": true, "10.1.0.4": false }),
+		}, want: []string{ "db.corp.internal A 10.1.0.1;10.1.0.2;10.1.0.3" } },
+		{ name: "address repeated across slices", endpoints: []interface{}{
+			testSlice("db-a", "db", "IPv4", map[string]bool{ "10.1.0.1": true }),
+			testSlice("db-b", "db", "IPv4", map[string]bool{ "10.1.0.1": true }),
+		}, want: []string{ "db.corp.internal A 10.1.0.1" } },
+		{ name: "FQDN slices are skipped", endpoints: []interface{}{
+			testSlice("db-a", "db", "FQDN", map[string]bool{ "db-0.corp.internal": true }),
+		}, want: []string{} },
+		{ name: "IPv6 slices publish nothing", endpoints: []interface{}{
+			testSlice("db-a", "db", "IPv6", map[string]bool{ "fd00::1": true }),
+		}, want: []string{} },
+		{ name: "slices of another Service", endpoints: []interface{}{
+			testSlice("cache-a", "cache", "IPv4", map[string]bool{ "10.1.0.9": true }),
+		}, want: []string{} },
+		{ name: "ready addresses of the Endpoints fallback", endpoints: []interface{}{
+			testEndpoints("db", []string{ "10.1.0.2", "10.1.0.1" }, []string{ "10.1.0.3" }),
+		}, want: []string{ "db.corp.internal A 10.1.0.1;10.1.0.2" } },
+		{ name: "Endpoints without ready addresses", endpoints: []interface{}{
+			testEndpoints("db", nil, []string{ "10.1.0.3" }),
+		}, want: []string{} },
+		{ name: "no endpoints", want: []string{} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestDNSHandler(t, []*core_v1.Service{ testService("db", fqdn, core_v1.ClusterIPNone, "", "") }, tt.endpoints...)
+			if got := desiredStrings(t, h, "default/db"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Desired(default/db) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSHandlerExternalName(t *testing.T) {
+	tests := []struct {
+		name    string
+		service *core_v1.Service
+		want    []string
+	}{
+		{ name: "CNAME to the external name", service: testService("ext", map[string]string{ FQDNAnnotation: "ext.corp.internal" }, "", "db.example.com", ""),
+			want: []string{ "ext.corp.internal CNAME db.example.com" } },
+		{ name: "a CNAME for each name", service: testService("ext", map[string]string{ FQDNAnnotation: "ext.corp.internal,db.corp.internal" }, "", "db.example.com", ""),
+			want: []string{ "ext.corp.internal CNAME db.example.com", "db.corp.internal CNAME db.example.com" } },
+		{ name: "no fqdn annotation", service: testService("ext", nil, "", "db.example.com", ""), want: []string{} },
+		{ name: "deleted Service", want: []string{} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services := []*core_v1.Service{}
+			if tt.service != nil {
+				services = append(services, tt.service)
+			}
+			h := newTestDNSHandler(t, services)
+			if got := desiredStrings(t, h, "default/ext"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Desired(default/ext) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSHandlerTTL(t *testing.T) {
+	SetTTLSettings(TTLSettings{ Default: 300, Min: 60, Max: 3600 })
+	defer SetTTLSettings(TTLSettings{ Default: 3600, Min: 1, Max: 86400 })
+
+	tests := []struct {
+		name string
+		ttl  string
+		want int
+	}{
+		{ name: "no annotation, the default", want: 300 },
+		{ name: "within the bounds", ttl: "120", want: 120 },
+		{ name: "the minimum", ttl: "60", want: 60 },
+		{ name: "the maximum", ttl: "3600", want: 3600 },
+		{ name: "below the minimum, the default", ttl: "59", want: 300 },
+		{ name: "above the maximum, the default", ttl: "3601", want: 300 },
+		{ name: "not a number, the default", ttl: "1h", want: 300 },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{ FQDNAnnotation: "app.corp.internal", "service.beta.kubernetes.io/azure-load-balancer-internal": "true" }
+			if tt.ttl != "" {
+				annotations[TTLAnnotation] = tt.ttl
+			}
+			h := newTestDNSHandler(t, []*core_v1.Service{ testService("app", annotations, "10.0.0.10", "", "10.240.0.7") })
+			entries, err := h.Desired("default/app")
+			if err != nil {
+				t.Fatalf("Desired(default/app): %v", err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("Desired(default/app) = %v, want one record", entryStrings(entries))
+			}
+			if entries[0].ttl != tt.want {
+				t.Errorf("TTL %q = %d, want %d", tt.ttl, entries[0].ttl, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSHandlerFQDNList(t *testing.T) {
+	tests := []struct {
+		name  string
+		fqdns string
+		want  []string
+	}{
+		{ name: "single name", fqdns: "app.corp.internal", want: []string{ "app.corp.internal A 10.240.0.7" } },
+		{ name: "comma separated names", fqdns: "app.corp.internal,api.corp.internal", want: []string{ "app.corp.internal A 10.240.0.7", "api.corp.internal A 10.240.0.7" } },
+		{ name: "spaces, trailing dots & empty items", fqdns: " app.corp.internal. , ,api.corp.internal ", want: []string{ "app.corp.internal A 10.240.0.7", "api.corp.internal A 10.240.0.7" } },
+		{ name: "repeated names", fqdns: "app.corp.internal,app.corp.internal.", want: []string{ "app.corp.internal A 10.240.0.7" } },
+		{ name: "wildcard", fqdns: "*.apps.corp.internal", want: []string{ "*.apps.corp.internal A 10.240.0.7" } },
+		{ name: "wildcard & its parent", fqdns: "apps.corp.internal,*.apps.corp.internal", want: []string{ "apps.corp.internal A 10.240.0.7", "*.apps.corp.internal A 10.240.0.7" } },
+		{ name: "only separators", fqdns: " , ", want: []string{} },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{ FQDNAnnotation: tt.fqdns, "service.beta.kubernetes.io/azure-load-balancer-internal": "true" }
+			h := newTestDNSHandler(t, []*core_v1.Service{ testService("app", annotations, "10.0.0.10", "", "10.240.0.7") })
+			if got := desiredStrings(t, h, "default/app"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Desired(default/app) with %q = %v, want %v", tt.fqdns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSHandlerFQDNTemplate(t *testing.T) {
+	internal := map[string]string{ "service.beta.kubernetes.io/azure-load-balancer-internal": "true" }
+	tests := []struct {
+		name        string
+		service     *core_v1.Service
+		want        []string
+		templateErr bool
+	}{
+		{ name: "internal LoadBalancer without the annotation", service: testService("app", internal, "10.0.0.10", "", "10.240.0.7"),
+			want: []string{ "app.default.aks.corp.internal A 10.240.0.7" } },
+		{ name: "the annotation wins", service: testService("app", map[string]string{ FQDNAnnotation: "app.corp.internal", "service.beta.kubernetes.io/azure-load-balancer-internal": "true" }, "10.0.0.10", "", "10.240.0.7"),
+			want: []string{ "app.corp.internal A 10.240.0.7" } },
+		{ name: "public LoadBalancer", service: testService("app", nil, "10.0.0.10", "", "20.0.0.7"), want: []string{} },
+		{ name: "headless Service", service: testService("app", internal, core_v1.ClusterIPNone, "", ""), want: []string{} },
+		{ name: "ExternalName Service", service: testService("app", internal, "", "db.example.com", ""), want: []string{} },
+		{ name: "missing label", service: testService("app", internal, "10.0.0.10", "", "10.240.0.7"), templateErr: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "{{.Name}}.{{.Namespace}}.aks.corp.internal"
+			if tt.templateErr {
+				text = "{{.Name}}.{{.Labels.team}}.aks.corp.internal"
+			}
+			tmpl, err := NewFQDNTemplate(text)
+			if err != nil {
+				t.Fatalf("NewFQDNTemplate(%q): %v", text, err)
+			}
+			h := newTestDNSHandler(t, []*core_v1.Service{ tt.service })
+			h.fqdnTemplate = tmpl
+
+			entries, err := h.Desired("default/app")
+			if tt.templateErr {
+				if _, ok := err.(*TemplateError); !ok {
+					t.Fatalf("Desired(default/app) error = %v, want a *TemplateError", err)
+				}
+				if len(entries) != 0 {
+					t.Errorf("Desired(default/app) = %v, want none", entryStrings(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Desired(default/app): %v", err)
+			}
+			if got := entryStrings(entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Desired(default/app) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSHandlerTargetOverride(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		lbIP   string
+		want   []string
+	}{
+		{ name: "no override, the load balancer IP", lbIP: "10.240.0.7", want: []string{ "app.corp.internal A 10.240.0.7" } },
+		{ name: "IP", target: "10.1.0.1", lbIP: "10.240.0.7", want: []string{ "app.corp.internal A 10.1.0.1" } },
+		{ name: "IPs", target: "10.1.0.2, 10.1.0.1", lbIP: "10.240.0.7", want: []string{ "app.corp.internal A 10.1.0.1;10.1.0.2" } },
+		{ name: "hostname, a CNAME", target: "appgw.corp.internal.", lbIP: "10.240.0.7", want: []string{ "app.corp.internal CNAME appgw.corp.internal" } },
+		{ name: "before the load balancer has an IP", target: "10.1.0.1", want: []string{ "app.corp.internal A 10.1.0.1" } },
+		{ name: "hostname among IPs, ignored", target: "10.1.0.1,appgw.corp.internal", lbIP: "10.240.0.7", want: []string{ "app.corp.internal A 10.240.0.7" } },
+		{ name: "several hostnames, ignored", target: "a.corp.internal,b.corp.internal", lbIP: "10.240.0.7", want: []string{ "app.corp.internal A 10.240.0.7" } },
+		{ name: "empty, ignored", target: " ", lbIP: "10.240.0.7", want: []string{ "app.corp.internal A 10.240.0.7" } },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{ FQDNAnnotation: "app.corp.internal", "service.beta.kubernetes.io/azure-load-balancer-internal": "true" }
+			if tt.target != "" {
+				annotations[TargetAnnotation] = tt.target
+			}
+			h := newTestDNSHandler(t, []*core_v1.Service{ testService("app", annotations, "10.0.0.10", "", tt.lbIP) })
+			if got := desiredStrings(t, h, "default/app"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Desired(default/app) with target %q = %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
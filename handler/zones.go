@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+	"private-dns/endpoint"
+	"private-dns/plan"
+	"private-dns/provider"
+)
+
+// zoneHandler makes the changes of a Handler in the provider's zones, each Handler embeds one & only works out
+// the records its cached objects publish
+type zoneHandler struct {
+	Provider provider.Provider
+	// name of the Handler, for the logs
+	name string
+	// published returns the records every cached object publishes, objects being deleted publish none
+	published func() []*endpoint.Endpoint
+}
+
+func newZoneHandler(name string, p provider.Provider, published func() []*endpoint.Endpoint) zoneHandler {
+	return zoneHandler{ Provider: p, name: name, published: published }
+}
+
+// Plan compares the records the cached objects publish with the records we own in the zones, and returns the
+// changes the policies allow
+func (z *zoneHandler) Plan(ctx context.Context, policies []plan.Policy) (*plan.Changes, error) {
+	klog.Infof("%s: Plan", z.name)
+	return planChanges(ctx, z.Provider, z.published(), policies)
+}
+
+// Reconcile applies the changes Plan returns, correcting drift, missed events & manual edits
+func (z *zoneHandler) Reconcile(ctx context.Context, policies []plan.Policy) error {
+	klog.Infof("%s: Reconcile", z.name)
+	changes, err := z.Plan(ctx, policies)
+	if err != nil {
+		return err
+	}
+	return reconcile(ctx, z.Provider, changes)
+}
+
+// Apply applies the changes of an earlier Plan, nothing is changed if a record they touch has changed since
+func (z *zoneHandler) Apply(ctx context.Context, changes *plan.Changes) error {
+	klog.Infof("%s: Apply", z.name)
+	return applyPlan(ctx, z.Provider, changes)
+}
+
+// Ping checks Azure DNS is reachable
+func (z *zoneHandler) Ping(ctx context.Context) error {
+	return z.Provider.Ping(ctx)
+}
+
+// ApplyChanges applies the change to the records of a single fqdn, limited by the SetPolicy policy
+func (z *zoneHandler) ApplyChanges(ctx context.Context, changes HashableDNSChanges) error {
+	apply, applyIt := HashDNSToPlan(changes)
+	if applyIt {
+		klog.Infof("%s: ApplyChanges", z.name)
+		return z.Provider.ApplyChanges(ctx, &apply)
+	}
+
+	klog.Infof("%s: Nothing Applied", z.name)
+	return nil
+}
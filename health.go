@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"private-dns/provider"
+)
+
+// controllerHealth tracks the workers for the liveness check, & how often Azure is pinged for the readiness check
+type controllerHealth struct {
+	mu sync.Mutex
+	// running is true while this replica runs the workers, a follower has a queue but no workers
+	running bool
+	// active is the number of workers processing a key
+	active int
+	// lastActivity is when a worker last took a key from the queue or finished one
+	lastActivity time.Time
+
+	// stallTimeout is how long the workers can go without activity, while there is work, before they are not healthy
+	stallTimeout time.Duration
+	// pingInterval is the period the zones are listed at, readiness needs a successful listing within 3 intervals
+	pingInterval time.Duration
+}
+
+func (h *controllerHealth) setRunning(running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = running
+	h.lastActivity = time.Now()
+}
+
+func (h *controllerHealth) started() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active++
+	h.lastActivity = time.Now()
+}
+
+func (h *controllerHealth) finished() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active--
+	h.lastActivity = time.Now()
+}
+
+// CheckHealth enables the liveness & readiness checks, the workers are not healthy if they have work but
+// take or finish no key for stallTimeout, & Azure is pinged every pingInterval for readiness
+func (c *Controller) CheckHealth(stallTimeout, pingInterval time.Duration) {
+	c.health.stallTimeout = stallTimeout
+	c.health.pingInterval = pingInterval
+}
+
+// ping lists the zones, a successful listing is recorded by the provider for Ready
+func (c *Controller) ping() {
+	if err := c.dnshandler.Ping(c.workCtx); err != nil {
+		klog.Errorf("Error listing Azure DNS zones: %v", err)
+	}
+}
+
+// Healthy returns an error if the workers have stopped pulling from the queue, eg wedged on a hung Azure call
+func (c *Controller) Healthy() error {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+
+	if !c.health.running || c.health.stallTimeout <= 0 {
+		return nil
+	}
+	if c.health.active == 0 && c.workqueue.Len() == 0 {
+		return nil
+	}
+	if since := time.Since(c.health.lastActivity); since > c.health.stallTimeout {
+		return fmt.Errorf("workers have not progressed for %v, %d keys processing & %d queued", since.Round(time.Second), c.health.active, c.workqueue.Len())
+	}
+	return nil
+}
+
+// Ready returns an error until the caches have synced, or if the zones have not been listed recently
+func (c *Controller) Ready() error {
+	if !c.HasSynced() {
+		return fmt.Errorf("caches have not synced")
+	}
+	if c.health.pingInterval <= 0 {
+		return nil
+	}
+	listed := provider.LastZoneListing()
+	if listed.IsZero() {
+		return fmt.Errorf("Azure DNS zones have not been listed")
+	}
+	if since := time.Since(listed); since > 3*c.health.pingInterval {
+		return fmt.Errorf("Azure DNS zones last listed %v ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+// checkHandler serves 200 "ok" when check passes, or 500 with its error
+func checkHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
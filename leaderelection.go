@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// leaderElectionConfig are the settings of the Lease the replicas elect a leader with
+type leaderElectionConfig struct {
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// runWithLeaderElection keeps the informer caches warm on every replica, and only runs the workers on the
+// holder of the Lease, so replicas never race on the same record sets
+func runWithLeaderElection(client kubernetes.Interface, controller *Controller, threadiness int, config leaderElectionConfig, stopCh <-chan struct{}) error {
+	if err := controller.Start(stopCh); err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: meta_v1.ObjectMeta{ Namespace: config.namespace, Name: config.name },
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{ Identity: config.identity },
+	}
+
+	// the Lease is released when ctx is cancelled, a leader only cancels it once its workers have drained,
+	// so the next leader is the only writer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leading := make(chan struct{})
+	go func() {
+		<-stopCh
+		select {
+		case <-leading:
+		default:
+			cancel()
+		}
+	}()
+
+	var err error
+	klog.Infof("Waiting to lead Lease %s/%s as %s", config.namespace, config.name, config.identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock: lock,
+		LeaseDuration: config.leaseDuration,
+		RenewDeadline: config.renewDeadline,
+		RetryPeriod: config.retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				close(leading)
+				klog.Infof("Started leading Lease %s/%s", config.namespace, config.name)
+
+				// stop the workers on a signal, or on losing the Lease
+				workersStop := make(chan struct{})
+				go func() {
+					select {
+					case <-stopCh:
+					case <-leaderCtx.Done():
+					}
+					close(workersStop)
+				}()
+				err = controller.RunWorkers(threadiness, workersStop)
+				cancel()
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					klog.Info("Released leadership")
+					return
+				}
+				// the workers may still be applying changes, exit so the new leader is the only writer
+				klog.Fatalf("Lost leadership of Lease %s/%s", config.namespace, config.name)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != config.identity {
+					klog.Infof("Lease %s/%s is led by %s", config.namespace, config.name, identity)
+				}
+			},
+		},
+	})
+	return err
+}
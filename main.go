@@ -5,6 +5,9 @@ import (
 	"os"
 	"fmt"
 	"flag"
+	"net/http"
+	"strings"
+	"time"
 	
 
 	// log system
@@ -16,41 +19,51 @@ import (
 
 	api_v1 "k8s.io/api/core/v1"
 	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typed_core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	"private-dns/handler"
+	"private-dns/metrics"
+	"private-dns/plan"
+	"private-dns/provider"
 )
 
 
 
-// retrieve the Kubernetes cluster client from outside of the cluster
-func getKubernetesClient(inCluster bool) kubernetes.Interface {
+// retrieve the Kubernetes cluster config with the standard client-go loading rules: the -kubeconfig file, or the
+// files in $KUBECONFIG merged, or ~/.kube/config, falling back to the in-cluster config when there are none
+func getKubernetesConfig(kubeconfig, context, master string) *rest.Config {
 
-	var config *rest.Config
-	var err error
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
 
-	if inCluster {
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
-		}
-	} else {
+	overrides := &clientcmd.ConfigOverrides{ CurrentContext: context }
+	overrides.ClusterInfo.Server = master
 
-		// construct the path to resolve to `~/.kube/config`
-		kubeConfigPath := os.Getenv("HOME") + "/.kube/config"
-		// create the config from the path
-		config, err = clientcmd.BuildConfigFromFlags("", kubeConfigPath)
-		if err != nil {
-			klog.Fatalf("getClusterConfig: %v", err)
-		}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		klog.Fatalf("getClusterConfig: %v", err)
 	}
 
+	return config
+}
+
+// retrieve the Kubernetes cluster client
+func getKubernetesClient(config *rest.Config) kubernetes.Interface {
+
 	// generate the client based off of the config
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -61,41 +74,235 @@ func getKubernetesClient(inCluster bool) kubernetes.Interface {
 	return client
 }
 
+// splitList returns the non empty items of a comma separated flag
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// servesResource returns true if the API server serves gvr, false when its CRD is not installed, an informer on
+// a resource that is not served never syncs
+func servesResource(client kubernetes.Interface, gvr schema.GroupVersionResource) (bool, error) {
+	resources, err := client.Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// serveHTTP runs the HTTP server for the /metrics, /healthz, /readyz & /debug/dead-letters endpoints
+func serveHTTP(address string, controller *Controller) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", checkHandler(controller.Healthy))
+	mux.Handle("/readyz", checkHandler(controller.Ready))
+	mux.Handle("/debug/dead-letters", controller.deadLettersHandler())
+
+	klog.Infof("Serving metrics & health checks on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Fatalf("Error serving metrics & health checks: %v", err)
+	}
+}
+
 // main code path
 func main() {
 
+	klog.InitFlags(nil)
 	flag.Set("alsologtostderr", "true")
 
 	rg := flag.String("azure-resource-group", "", "Resource Group containing your Azure Private DNS Zone resource")
 	subID := flag.String("azure-subscription-id", "", "Subscription Id for in-cluster pod-identity")
-	inCluster :=  flag.Bool("in-cluster", true , "are we running in the cluster?")
+	inCluster :=  flag.Bool("in-cluster", true , "Deprecated, use -azure-auth, sets its default: env when true, file when false")
+	azureAuth := flag.String("azure-auth", "", "Azure credentials: env (Pod Identity or AZURE_CLIENT_ID & AZURE_CLIENT_SECRET, with -azure-subscription-id) or file (AZURE_AUTH_LOCATION)")
+	kubeconfig := flag.String("kubeconfig", "", "Kubernetes config file (default the files in $KUBECONFIG, or ~/.kube/config, or the in-cluster config when there are none)")
+	kubeContext := flag.String("context", "", "Context in the Kubernetes config to use (default the current context)")
+	master := flag.String("master", "", "Address of the Kubernetes API server, overrides the Kubernetes config")
 	publicZone :=  flag.Bool("public-zone", false , "Use a Public DNS Zone")
+	configFile := flag.String("config", "", "YAML config file, eg a mounted ConfigMap, flags given on the command line take precedence over it")
+	configReloadInterval := flag.Duration("config-reload-interval", 10*time.Second, "Interval between checks of -config for changes, the filters, TTLs & log level are applied without a restart, 0 to disable")
+	namespace := flag.String("namespace", "", "Namespace watched with -source=service, ingress or gateway, * for all (default: default with -source=service, all otherwise), -source=istio always watches every namespace")
+	annotationPrefix := flag.String("annotation-prefix", handler.DefaultAnnotationPrefix, "Start of the name of every annotation & the finalizer the controller reads & writes")
+	source := flag.String("source", "", "Objects to watch: service, ingress, gateway, istio or node (default service for private zones, ingress for public zones)")
+	flag.Int("default-ttl", 3600, "TTL in seconds for records without a "+handler.TTLAnnotation+" annotation")
+	flag.Int("min-ttl", 1, "Lowest TTL in seconds accepted from a "+handler.TTLAnnotation+" annotation")
+	flag.Int("max-ttl", 86400, "Highest TTL in seconds accepted from a "+handler.TTLAnnotation+" annotation")
+	fqdnTemplate := flag.String("fqdn-template", "", "text/template naming internal LoadBalancer Services & Ingresses without a fqdn annotation or rule host, eg '{{.Name}}.{{.Namespace}}.aks.corp.internal'")
+	ownerID := flag.String("owner-id", "", "Owner label stored in the metadata of every record this controller publishes, reconciliation only changes records with this owner (default private-dns-<source>)")
+	policyName := flag.String("policy", "sync", "Changes the controller may make to the records it owns: sync (create, update & delete), upsert-only (no deletes) or create-only")
+	reconcileInterval := flag.Duration("reconcile-interval", 10*time.Minute, "Interval between full reconciliations of every watched object against the DNS zones, 0 to disable")
+	nodeFQDNTemplate := flag.String("node-fqdn-template", "{{.Name}}.nodes.internal", "text/template over the Node naming each node's record with -source=node")
+	nodeExternalIP := flag.Bool("node-external-ip", false, "Publish node ExternalIPs as well as InternalIPs with -source=node")
+	nodeAggregateFQDN := flag.String("node-aggregate-fqdn", "", "Record listing all ready nodes matching -node-selector with -source=node, disabled if empty")
+	nodeSelector := flag.String("node-selector", "", "Label selector for the nodes in -node-aggregate-fqdn")
+	finalizer := flag.Bool("finalizer", false, "Add the "+handler.Finalizer+" finalizer to objects publishing records, so a deleted object waits for its records to be removed")
+	leaderElect := flag.Bool("leader-elect", false, "Elect a leader with a Lease so only one replica runs the workers, the others keep warm caches for a fast failover")
+	leaderElectNamespace := flag.String("leader-elect-namespace", "", "Namespace of the leader election Lease (default $POD_NAMESPACE, or default)")
+	leaderElectName := flag.String("leader-elect-name", "", "Name of the leader election Lease (default the -owner-id)")
+	leaderElectIdentity := flag.String("leader-elect-identity", "", "Identity of this replica in the leader election Lease (default the hostname)")
+	leaseDuration := flag.Duration("leader-elect-lease-duration", 15*time.Second, "Time followers wait after the last renewal before taking the Lease")
+	renewDeadline := flag.Duration("leader-elect-renew-deadline", 10*time.Second, "Time the leader keeps retrying to renew the Lease before giving it up")
+	retryPeriod := flag.Duration("leader-elect-retry-period", 2*time.Second, "Time between attempts to take or renew the Lease")
+	azureListTimeout := flag.Duration("azure-list-timeout", time.Minute, "Longest an Azure DNS listing of the zones, or of the records in a zone, may take, 0 for no limit")
+	azureWriteTimeout := flag.Duration("azure-write-timeout", 30*time.Second, "Longest an Azure DNS record write or delete may take, 0 for no limit")
+	maxRetries := flag.Int("max-retries", 5, "Times a key that fails is retried before it is parked as a dead letter, listed on /debug/dead-letters")
+	retryBaseDelay := flag.Duration("retry-base-delay", 5*time.Millisecond, "Delay before the first retry of a failed key, doubled on each retry")
+	retryMaxDelay := flag.Duration("retry-max-delay", 1000*time.Second, "Longest delay between the retries of a failed key")
+	deadLetterInterval := flag.Duration("dead-letter-interval", 10*time.Minute, "Interval the dead letters are re-attempted at, with up to half an interval of jitter, 0 to only re-attempt them on the object's next change")
+	shutdownGracePeriod := flag.Duration("shutdown-grace-period", 25*time.Second, "Time the keys being processed have to finish after a SIGTERM or SIGINT, before their changes are cancelled & the controller exits with 1, keep the pod's terminationGracePeriodSeconds at least this plus -azure-write-timeout")
+	metricsAddress := flag.String("metrics-address", ":8080", "Address of the HTTP server for the Prometheus /metrics endpoint & the /healthz & /readyz checks & the /debug/dead-letters list, empty to disable")
+	stallTimeout := flag.Duration("liveness-stall-timeout", 5*time.Minute, "Time the workers can have work without taking or finishing a key before /healthz fails, 0 to disable")
+	azureCheckInterval := flag.Duration("azure-check-interval", time.Minute, "Interval between listings of the Azure DNS zones, /readyz fails without a successful listing in 3 intervals, 0 to disable")
+	events := flag.Bool("events", true, "Emit Kubernetes Events on the objects whose records are changed, skipped or fail")
+	statusAnnotation := flag.Bool("status-annotation", true, "Write the "+handler.StatusAnnotation+" annotation, with the zone, name & targets of the records & the last sync result, to the objects whose records change")
+	dryRun := flag.Bool("dry-run", false, "Make no changes to the DNS zones, add no finalizers, status annotations or Events, write each change that would be made to -dry-run-output as a JSON line, the finalizer is still removed from objects being deleted")
+	dryRunOutput := flag.String("dry-run-output", "-", "File the -dry-run changes are appended to, - for stdout")
+	gatewayRoutes := flag.String("gateway-routes", "httproute,grpcroute", "Comma separated Gateway API route kinds to watch with -source=gateway, httproute, grpcroute or tlsroute, a kind whose CRD is not installed is skipped")
+	flag.String("domain-filter", "", "Comma separated domains, with their subdomains, the controller may manage records in (default all)")
+	flag.String("exclude-domains", "", "Comma separated domains, with their subdomains, the controller never manages records in")
+	flag.String("regex-domain-filter", "", "Regular expression the names of managed records must match")
+	flag.String("regex-domain-exclusion", "", "Regular expression the names of managed records must not match")
+	flag.String("zone-name-filter", "", "Comma separated names of the zones in the resource group the controller may manage (default all)")
+	flag.String("zone-tag-filter", "", "Comma separated key=value Azure tags a zone must carry to be managed, a key alone matches any value")
+	flag.String("zone-id-filter", "", "Comma separated Azure resource IDs of the zones the controller may manage (default all)")
+	planFile := flag.String("plan-file", "", "File the plan command saves its changes to, and the apply command reads them from")
+	planOutput := flag.String("plan-output", "text", "Format the plan command writes its changes to stdout in: text or json")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [plan|apply] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  (no command)  run the controller\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  plan          list the watched objects once & print the changes a reconciliation would make\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  apply         apply the changes saved by plan to -plan-file\n\n")
+		flag.PrintDefaults()
+	}
 
-	flag.Parse()
+	// the one-shot plan & apply commands come before the flags
+	command := ""
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "plan" || args[0] == "apply") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	flag.Set("logtostderr", "true")
 
+	// the flags given on the command line take precedence over the config file
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var watcher *configWatcher
+	var err error
+	if *configFile != "" {
+		if watcher, err = loadConfig(*configFile, explicit); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if len(*rg) == 0 {
 		fmt.Fprintf(os.Stderr, "error: No resource_group\n")
         os.Exit(1)
 	}
 
-	var dnshandler handler.Handler
-	var err error
-	if *publicZone {
-		dnshandler, err = handler.NewIngressHandler (*inCluster, *rg, *subID)
-	} else {
-		dnshandler, err = handler.NewDNSHandler(*inCluster, *rg, *subID)
-		
+	if *leaderElect && (*leaseDuration <= *renewDeadline || *renewDeadline <= *retryPeriod) {
+		fmt.Fprintf(os.Stderr, "error: -leader-elect-lease-duration must be greater than -leader-elect-renew-deadline, and that greater than -leader-elect-retry-period\n")
+		os.Exit(1)
+	}
+	if command == "apply" && *planFile == "" {
+		fmt.Fprintf(os.Stderr, "error: apply needs the -plan-file saved by plan\n")
+		os.Exit(1)
 	}
+	if *planOutput != "text" && *planOutput != "json" {
+		fmt.Fprintf(os.Stderr, "error: -plan-output must be text or json\n")
+		os.Exit(1)
+	}
+
+	policy, ok := plan.Policies[*policyName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: -policy must be sync, upsert-only or create-only\n")
+		os.Exit(1)
+	}
+	handler.SetPolicy(policy)
 
+	settings, err := parseDynamicSettings(flagValue)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot initialise handler, %v\n", err)
-        os.Exit(1)
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	settings.apply()
+
+	handler.SetAnnotationPrefix(*annotationPrefix)
+	provider.SetTimeouts(*azureListTimeout, *azureWriteTimeout)
+
+	// the Azure credentials no longer follow where Kubernetes is, -in-cluster only remains as the default
+	if *azureAuth == "" {
+		*azureAuth = string(provider.AzureAuthFile)
+		if *inCluster {
+			*azureAuth = string(provider.AzureAuthEnvironment)
+		}
+	}
+	if *azureAuth != string(provider.AzureAuthEnvironment) && *azureAuth != string(provider.AzureAuthFile) {
+		fmt.Fprintf(os.Stderr, "error: -azure-auth must be env or file\n")
+		os.Exit(1)
+	}
+
+	tmpl, err := handler.NewFQDNTemplate(*fqdnTemplate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: cannot parse -fqdn-template, %v\n", err)
+		os.Exit(1)
+	}
+
+	if *source == "" {
+		if *publicZone {
+			*source = "ingress"
+		} else {
+			*source = "service"
+		}
+	}
+
+	if *ownerID == "" {
+		*ownerID = "private-dns-" + *source
+	}
+	handler.SetOwnerID(*ownerID)
+
+	if *dryRun {
+		out := os.Stdout
+		if *dryRunOutput != "-" {
+			if out, err = os.OpenFile(*dryRunOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "error: cannot open -dry-run-output, %v\n", err)
+				os.Exit(1)
+			}
+			defer out.Close()
+		}
+		provider.SetDryRun(true, out)
+
+		// the finalizer, status & Events would describe changes that were never made, an object being deleted still
+		// has the finalizer removed, so one added by an earlier run does not hold it forever
+		klog.Info("Dry run: no changes will be made to the DNS zones, adding finalizers, status annotations & Events are disabled")
+		*finalizer = false
+		*statusAnnotation = false
+		*events = false
 	}
 
 	// get the Kubernetes client for connectivity
-	client := getKubernetesClient(*inCluster)
+	config := getKubernetesConfig(*kubeconfig, *kubeContext, *master)
+	client := getKubernetesClient(config)
+	// the dynamic client watches the Gateway API & Istio resources, and patches objects of any kind
+	dynClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("getClusterConfig: %v", err)
+	}
 
 	// Informer/SharedInformer watches for changes on the current state of Kubernetes objects 
 	// and sends events to Workqueue where events are then popped up by worker(s) to process.
@@ -114,18 +321,139 @@ func main() {
 
 	// All of these things are consumed in Informer.
 
+	// -source=service watches the default namespace unless -namespace is given, the other sources every namespace
+	watchNamespace := *namespace
+	if watchNamespace == "*" {
+		watchNamespace = meta_v1.NamespaceAll
+	} else if watchNamespace == "" && *source == "service" {
+		watchNamespace = meta_v1.NamespaceDefault
+	}
+
+	if *maxRetries < 0 || *retryBaseDelay <= 0 || *retryMaxDelay < *retryBaseDelay {
+		fmt.Fprintf(os.Stderr, "error: -max-retries must be at least 0, and -retry-max-delay at least -retry-base-delay\n")
+		os.Exit(1)
+	}
+	retry := retryConfig{ maxRetries: *maxRetries, baseDelay: *retryBaseDelay, maxDelay: *retryMaxDelay, deadLetterInterval: *deadLetterInterval }
+
 	var controller *Controller
-	if *publicZone {
+	switch *source {
+	case "gateway":
+		// Gateway API, listen for Gateways and the routes attached to them
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynClient, 0, watchNamespace, nil)
+
+		if served, err := servesResource(client, handler.GatewayResource); err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot discover the Gateway API, %v\n", err)
+			os.Exit(1)
+		} else if !served {
+			fmt.Fprintf(os.Stderr, "error: %s is not served by the cluster, install the Gateway API CRDs\n", handler.GatewayResource)
+			os.Exit(1)
+		}
+		gatewayInformer := factory.ForResource(handler.GatewayResource).Informer()
+		routeInformers := []cache.SharedIndexInformer{}
+		for _, kind := range strings.Split(*gatewayRoutes, ",") {
+			gvr, ok := handler.GatewayRouteResources[strings.ToLower(strings.TrimSpace(kind))]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "error: unknown gateway route kind %q\n", kind)
+				os.Exit(1)
+			}
+			// eg TLSRoute is only in the experimental channel, its informer would never sync without the CRD
+			served, err := servesResource(client, gvr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: cannot discover the gateway route kind %q, %v\n", kind, err)
+				os.Exit(1)
+			}
+			if !served {
+				klog.Warningf("Skipping the gateway route kind %q, %s is not served by the cluster", kind, gvr)
+				continue
+			}
+			routeInformers = append(routeInformers, factory.ForResource(gvr).Informer())
+		}
+
+		dnshandler, err := handler.NewGatewayHandler(*publicZone, provider.AzureAuth(*azureAuth), *rg, *subID, gatewayInformer, routeInformers...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot initialise handler, %v\n", err)
+			os.Exit(1)
+		}
+
+		controller = NewController(client, dynClient, dnshandler, retry, append(routeInformers, gatewayInformer)...)
+
+	case "istio":
+		// Istio, listen for Gateways, VirtualServices and the ingress-gateway Services they select
+		// every namespace, the Gateways & ingress-gateway Services usually live apart from the VirtualServices bound to them
+		factory := dynamicinformer.NewDynamicSharedInformerFactory(dynClient, 0)
+		if *namespace != "" {
+			klog.Warningf("Ignoring -namespace=%s, -source=istio watches every namespace", *namespace)
+		}
+
+		// an informer for a resource the cluster does not serve would never sync
+		for _, gvr := range []schema.GroupVersionResource{ handler.IstioGatewayResource, handler.IstioVirtualServiceResource } {
+			if served, err := servesResource(client, gvr); err != nil {
+				fmt.Fprintf(os.Stderr, "error: cannot discover the Istio networking API, %v\n", err)
+				os.Exit(1)
+			} else if !served {
+				fmt.Fprintf(os.Stderr, "error: %s is not served by the cluster, install Istio\n", gvr)
+				os.Exit(1)
+			}
+		}
+		gatewayInformer := factory.ForResource(handler.IstioGatewayResource).Informer()
+		virtualServiceInformer := factory.ForResource(handler.IstioVirtualServiceResource).Informer()
+		serviceInformer := cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+					return client.CoreV1().Services("").List(options)
+				},
+				WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+					return client.CoreV1().Services("").Watch(options)
+				},
+			},
+			&api_v1.Service{},
+			0,             // no resync (period of 0)
+			cache.Indexers{},
+		)
+
+		dnshandler, err := handler.NewIstioHandler(*publicZone, provider.AzureAuth(*azureAuth), *rg, *subID, gatewayInformer, virtualServiceInformer, serviceInformer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot initialise handler, %v\n", err)
+			os.Exit(1)
+		}
+
+		controller = NewController(client, dynClient, dnshandler, retry, serviceInformer, gatewayInformer, virtualServiceInformer)
+
+	case "node":
+		// Nodes, for hostNetwork & NodePort based workloads
+		nodeInformer := cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+					return client.CoreV1().Nodes().List(options)
+				},
+				WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+					return client.CoreV1().Nodes().Watch(options)
+				},
+			},
+			&api_v1.Node{},
+			0,             // no resync (period of 0)
+			cache.Indexers{},
+		)
+
+		dnshandler, err := handler.NewNodeHandler(*publicZone, provider.AzureAuth(*azureAuth), *rg, *subID, nodeInformer, *nodeFQDNTemplate, *nodeExternalIP, *nodeAggregateFQDN, *nodeSelector)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot initialise handler, %v\n", err)
+			os.Exit(1)
+		}
+
+		controller = NewController(client, dynClient, dnshandler, retry, nodeInformer)
+
+	case "ingress":
 		// Public Zone, listen for Ingress
 		ingressInformer := cache.NewSharedIndexInformer(
 			&cache.ListWatch{
 				ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
 
-					return client.ExtensionsV1beta1().Ingresses("").List(options)
+					return client.ExtensionsV1beta1().Ingresses(watchNamespace).List(options)
 				},
 				WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
 
-					return client.ExtensionsV1beta1().Ingresses("").Watch(options)
+					return client.ExtensionsV1beta1().Ingresses(watchNamespace).Watch(options)
 				},
 			},
 			&extensionsv1beta1.Ingress{},
@@ -133,9 +461,15 @@ func main() {
 			cache.Indexers{},
 		)
 
-		controller = NewController(client, ingressInformer, dnshandler)
+		dnshandler, err := handler.NewIngressHandler (provider.AzureAuth(*azureAuth), *rg, *subID, tmpl, ingressInformer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot initialise handler, %v\n", err)
+			os.Exit(1)
+		}
+
+		controller = NewController(client, dynClient, dnshandler, retry, ingressInformer)
 	
-	} else {
+	case "service":
 		// Private Zone, listen for Service
 		serviceInformer := cache.NewSharedIndexInformer(
 			// the ListWatch contains two different functions that our
@@ -143,36 +477,156 @@ func main() {
 			// the resources we want to handle
 			&cache.ListWatch{
 				ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
-					// list all of the pods (core resource) in the deafult namespace
-					return client.CoreV1().Services(meta_v1.NamespaceDefault).List(options)
+					// list all of the services (core resource) in the watched namespace
+					return client.CoreV1().Services(watchNamespace).List(options)
 				},
 				WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
-					// watch all of the pods (core resource) in the default namespace
-					return client.CoreV1().Services(meta_v1.NamespaceDefault).Watch(options)
+					// watch all of the services (core resource) in the watched namespace
+					return client.CoreV1().Services(watchNamespace).Watch(options)
 				},
 			},
 			&api_v1.Service{}, // the target type (Service)
 			0,             // no resync (period of 0)
 			cache.Indexers{},
 		)
+
+		// and the EndpointSlices, or the Endpoints on a cluster without them, for the ready addresses of headless Services
+		slices, err := servesResource(client, handler.EndpointSliceResource)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot discover the EndpointSlice API, %v\n", err)
+			os.Exit(1)
+		}
+		var endpointsInformer cache.SharedIndexInformer
+		if slices {
+			klog.Info("Watching EndpointSlices for the addresses of headless Services")
+			endpointsInformer = dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynClient, 0, watchNamespace, nil).ForResource(handler.EndpointSliceResource).Informer()
+		} else {
+			klog.Infof("Watching Endpoints for the addresses of headless Services, %s is not served by the cluster", handler.EndpointSliceResource)
+			endpointsInformer = cache.NewSharedIndexInformer(
+				&cache.ListWatch{
+					ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+						return client.CoreV1().Endpoints(watchNamespace).List(options)
+					},
+					WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+						return client.CoreV1().Endpoints(watchNamespace).Watch(options)
+					},
+				},
+				&api_v1.Endpoints{},
+				0,             // no resync (period of 0)
+				cache.Indexers{},
+			)
+		}
+
+		dnshandler, err := handler.NewDNSHandler(provider.AzureAuth(*azureAuth), *rg, *subID, tmpl, serviceInformer, endpointsInformer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot initialise handler, %v\n", err)
+			os.Exit(1)
+		}
 		
-		controller = NewController(client, serviceInformer, dnshandler)
+		controller = NewController(client, dynClient, dnshandler, retry, serviceInformer, endpointsInformer)
+
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown source %q\n", *source)
+		os.Exit(1)
+	}
+
+	policies := []plan.Policy{ policy }
+
+	switch command {
+	case "plan":
+		if err = runPlan(controller, policies, *planOutput, *planFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: plan failed, %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "apply":
+		// the plan was worked out from the objects, apply only needs the zones
+		if err = runApply(controller.dnshandler, *planFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: apply failed, %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *finalizer {
+		controller.UseFinalizer()
+	}
+	if *events {
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typed_core_v1.EventSinkImpl{ Interface: client.CoreV1().Events("") })
+		controller.RecordEvents(broadcaster.NewRecorder(scheme.Scheme, api_v1.EventSource{ Component: "private-dns" }))
+	}
+	if *statusAnnotation {
+		controller.WriteStatus()
+	}
 
+	controller.CheckHealth(*stallTimeout, *azureCheckInterval)
+	if *metricsAddress != "" {
+		go serveHTTP(*metricsAddress, controller)
 	}
 
+	controller.ReconcileEvery(*reconcileInterval, policies)
+
+	controller.DrainWithin(*shutdownGracePeriod)
+
 	// use a channel to synchronize the finalization for a graceful shutdown
 	stopCh := make(chan struct{})
-	defer close(stopCh)
+
+	// use a channel to handle OS signals to terminate and gracefully shut
+	// down processing, a second signal exits at once
+	sigTerm := make(chan os.Signal, 2)
+	signal.Notify(sigTerm, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigTerm
+		klog.Infof("Received %v, shutting down", sig)
+		close(stopCh)
+		sig = <-sigTerm
+		klog.Errorf("Received %v while shutting down, exiting", sig)
+		klog.Flush()
+		os.Exit(1)
+	}()
+
+	if watcher != nil && *configReloadInterval > 0 {
+		go wait.Until(watcher.check, *configReloadInterval, stopCh)
+	}
 
 	// run the controller loop to process items
-	if err := controller.Run(2, stopCh); err != nil {
+	if *leaderElect {
+		if *leaderElectNamespace == "" {
+			*leaderElectNamespace = os.Getenv("POD_NAMESPACE")
+		}
+		if *leaderElectNamespace == "" {
+			*leaderElectNamespace = meta_v1.NamespaceDefault
+		}
+		if *leaderElectName == "" {
+			*leaderElectName = *ownerID
+		}
+		if *leaderElectIdentity == "" {
+			if *leaderElectIdentity, err = os.Hostname(); err != nil {
+				klog.Fatalf("Error getting hostname for leader election: %v", err)
+			}
+		}
+
+		err = runWithLeaderElection(client, controller, 2, leaderElectionConfig{
+			namespace: *leaderElectNamespace,
+			name: *leaderElectName,
+			identity: *leaderElectIdentity,
+			leaseDuration: *leaseDuration,
+			renewDeadline: *renewDeadline,
+			retryPeriod: *retryPeriod,
+		}, stopCh)
+	} else {
+		err = controller.Run(2, stopCh)
+	}
+	if err == errNotDrained {
+		// the exit code tells the changes being made were cancelled
+		klog.Errorf("Shut down without draining: %v", err)
+		klog.Flush()
+		os.Exit(1)
+	}
+	if err != nil {
 		klog.Fatalf("Error running controller: %s", err.Error())
 	}
-
-	// use a channel to handle OS signals to terminate and gracefully shut
-	// down processing
-	sigTerm := make(chan os.Signal, 1)
-	signal.Notify(sigTerm, syscall.SIGTERM)
-	signal.Notify(sigTerm, syscall.SIGINT)
-	<-sigTerm
+	klog.Info("Shut down, the workers drained")
+	klog.Flush()
 }
\ No newline at end of file
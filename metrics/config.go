@@ -0,0 +1,15 @@
+package metrics
+
+// config file metrics
+var (
+	configReloads = newCounterVec("private_dns_config_reloads_total", "Total number of config file reloads by result, applied or rejected.", "result")
+)
+
+// ConfigReloaded counts a reload of the config file, rejected when err is set
+func ConfigReloaded(err error) {
+	if err != nil {
+		configReloads.WithLabelValues("rejected").Inc()
+		return
+	}
+	configReloads.WithLabelValues("applied").Inc()
+}
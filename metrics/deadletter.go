@@ -0,0 +1,27 @@
+package metrics
+
+// dead letter metrics, the keys that failed every retry
+var (
+	deadLetters = newGauge("private_dns_dead_letters", "Current number of keys parked after failing every retry.")
+	deadLettered = newCounterVec("private_dns_dead_lettered_total", "Total number of failed attempts of parked keys, first when the key was parked, reattempt when a re-attempt failed.", "attempt")
+	deadLetterRecoveries = newCounter("private_dns_dead_letter_recoveries_total", "Total number of parked keys that synced on a re-attempt or a new event.")
+)
+
+// SetDeadLetters sets the number of parked keys
+func SetDeadLetters(n int) {
+	deadLetters.Set(float64(n))
+}
+
+// DeadLettered counts a key parked, first the first time, or a failed re-attempt
+func DeadLettered(first bool) {
+	if first {
+		deadLettered.WithLabelValues("first").Inc()
+		return
+	}
+	deadLettered.WithLabelValues("reattempt").Inc()
+}
+
+// DeadLetterRecovered counts a parked key that synced
+func DeadLetterRecovered() {
+	deadLetterRecoveries.Inc()
+}
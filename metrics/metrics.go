@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DurationBuckets are the histogram buckets in seconds used for request & queue latencies
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Handler serves every registered metric, with the process & Go runtime metrics, in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// newCounter creates & registers a Counter without labels
+func newCounter(name, help string) prometheus.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{ Name: name, Help: help })
+	prometheus.MustRegister(c)
+	return c
+}
+
+// newCounterVec creates & registers a Counter per combination of label values
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{ Name: name, Help: help }, labels)
+	prometheus.MustRegister(c)
+	return c
+}
+
+// newGauge creates & registers a Gauge without labels
+func newGauge(name, help string) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{ Name: name, Help: help })
+	prometheus.MustRegister(g)
+	return g
+}
+
+// newGaugeVec creates & registers a Gauge per combination of label values
+func newGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{ Name: name, Help: help }, labels)
+	prometheus.MustRegister(g)
+	return g
+}
+
+// newHistogramVec creates & registers a Histogram with the (ascending) bucket upper bounds per combination of label values
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{ Name: name, Help: help, Buckets: buckets }, labels)
+	prometheus.MustRegister(h)
+	return h
+}
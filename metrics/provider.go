@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// Azure DNS metrics, zone & code are bounded by the zones in the resource group & the HTTP status codes
+var (
+	azureRequests = newCounterVec("private_dns_azure_requests_total", "Total number of Azure DNS API calls by operation & result code.", "provider", "operation", "code")
+	azureDuration = newHistogramVec("private_dns_azure_request_duration_seconds", "Latency in seconds of Azure DNS API calls by operation.", DurationBuckets, "provider", "operation")
+	records = newCounterVec("private_dns_records_total", "Total number of records created, updated & deleted by zone.", "zone", "action")
+	skippedNoZone = newCounter("private_dns_skipped_no_zone_total", "Total number of records skipped because no zone matched their name.")
+	skippedPolicy = newCounterVec("private_dns_skipped_by_policy_total", "Total number of record changes skipped because the policy does not allow them, by action.", "action")
+)
+
+// ObserveAzureCall records an Azure API call that started at start & returned err
+func ObserveAzureCall(provider, operation string, start time.Time, err error) {
+	azureRequests.WithLabelValues(provider, operation, resultCode(err)).Inc()
+	azureDuration.WithLabelValues(provider, operation).Observe(time.Since(start).Seconds())
+}
+
+// RecordChanged counts a record created, updated or deleted in zone
+func RecordChanged(zone, action string) {
+	records.WithLabelValues(zone, action).Inc()
+}
+
+// SkippedNoZone counts a record skipped because no zone matched its name
+func SkippedNoZone() {
+	skippedNoZone.Inc()
+}
+
+// SkippedByPolicy counts a record create, update or delete the policy does not allow
+func SkippedByPolicy(action string) {
+	skippedPolicy.WithLabelValues(action).Inc()
+}
+
+// resultCode returns "ok", "timeout" for a call that ran out of time, the HTTP status code of a failed call,
+// or "error" when there was no response
+func resultCode(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+		return "timeout"
+	}
+	if detailed, ok := err.(autorest.DetailedError); ok {
+		if code, ok := detailed.StatusCode.(int); ok && code > 0 {
+			return strconv.Itoa(code)
+		}
+	}
+	return "error"
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"k8s.io/client-go/util/workqueue"
+)
+
+// workqueue metrics, labelled with the name of the queue
+var (
+	workqueueDepth = newGaugeVec("private_dns_workqueue_depth", "Current depth of the workqueue.", "name")
+	workqueueAdds = newCounterVec("private_dns_workqueue_adds_total", "Total number of adds handled by the workqueue.", "name")
+	workqueueLatency = newHistogramVec("private_dns_workqueue_queue_duration_seconds", "How long in seconds a key stays in the workqueue before being processed.", DurationBuckets, "name")
+	workqueueWorkDuration = newHistogramVec("private_dns_workqueue_work_duration_seconds", "How long in seconds processing a key from the workqueue takes.", DurationBuckets, "name")
+	workqueueUnfinished = newGaugeVec("private_dns_workqueue_unfinished_work_seconds", "Seconds of work in progress not yet observed by work_duration, large values suggest stuck workers.", "name")
+	workqueueLongestRunning = newGaugeVec("private_dns_workqueue_longest_running_processor_seconds", "Seconds the longest running worker has been processing its key.", "name")
+	workqueueRetries = newCounterVec("private_dns_workqueue_retries_total", "Total number of retries handled by the workqueue.", "name")
+)
+
+// the provider must be set before a named workqueue is created, so it is set when this package is loaded
+func init() {
+	workqueue.SetProvider(workqueueProvider{})
+}
+
+type workqueueProvider struct{}
+
+func (workqueueProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinished.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunning.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"k8s.io/klog/v2"
+
+	"private-dns/endpoint"
+	"private-dns/handler"
+	"private-dns/plan"
+)
+
+// runPlan lists the watched objects once, and writes the changes a reconciliation would make to stdout as a
+// diff or as JSON, the changes are saved to file for apply when it is set
+func runPlan(controller *Controller, policies []plan.Policy, output string, file string) error {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	if err := controller.Start(stopCh); err != nil {
+		return err
+	}
+
+	changes, err := controller.dnshandler.Plan(context.Background(), policies)
+	if err != nil {
+		return err
+	}
+
+	if file != "" {
+		data, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+		klog.Infof("Plan saved to %s", file)
+	}
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	default:
+		printPlan(os.Stdout, changes)
+		return nil
+	}
+}
+
+// runApply applies the changes saved to file by plan
+func runApply(dnshandler handler.Handler, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	changes := &plan.Changes{}
+	if err = json.Unmarshal(data, changes); err != nil {
+		return fmt.Errorf("cannot read plan %s, %v", file, err)
+	}
+	if len(changes.UpdateOld) != len(changes.UpdateNew) {
+		return fmt.Errorf("cannot read plan %s, UpdateOld & UpdateNew differ in length", file)
+	}
+
+	if err = dnshandler.Apply(context.Background(), changes); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Applied: %d created, %d updated, %d deleted\n", len(changes.Create), len(changes.UpdateNew), len(changes.Delete))
+	return nil
+}
+
+// printPlan writes the changes as a diff, + for a record created, ~ updated & - deleted, ordered by name
+func printPlan(w io.Writer, changes *plan.Changes) {
+	if handler.NoChanges(changes) {
+		fmt.Fprintln(w, "No changes, the records are in sync")
+		return
+	}
+
+	lines := []string{}
+	for _, ep := range changes.Create {
+		lines = append(lines, fmt.Sprintf("+ %s %s: %s", ep.DNSName, ep.RecordType, planRecord(ep)))
+	}
+	for i, ep := range changes.UpdateNew {
+		lines = append(lines, fmt.Sprintf("~ %s %s: %s => %s", ep.DNSName, ep.RecordType, planRecord(changes.UpdateOld[i]), planRecord(ep)))
+	}
+	for _, ep := range changes.Delete {
+		lines = append(lines, fmt.Sprintf("- %s %s: %s", ep.DNSName, ep.RecordType, planRecord(ep)))
+	}
+	// sort on the name, not the leading action
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+	fmt.Fprintf(w, "\nPlan: %d to create, %d to update, %d to delete\n", len(changes.Create), len(changes.UpdateNew), len(changes.Delete))
+}
+
+// planRecord returns the TTL & targets of a record
+func planRecord(ep *endpoint.Endpoint) string {
+	return fmt.Sprintf("ttl %d %s", ep.RecordTTL, ep.Targets)
+}
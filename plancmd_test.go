@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"private-dns/endpoint"
+	"private-dns/plan"
+)
+
+func TestPrintPlan(t *testing.T) {
+	a := func(name string, ttl endpoint.TTL, targets ...string) *endpoint.Endpoint {
+		return endpoint.NewEndpointWithTTL(name, endpoint.RecordTypeA, ttl, targets...)
+	}
+	tests := []struct {
+		name    string
+		changes *plan.Changes
+		want    string
+	}{
+		{ name: "no changes", changes: &plan.Changes{}, want: "No changes, the records are in sync\n" },
+		{ name: "ordered by name, not action",
+			changes: &plan.Changes{
+				Create:    []*endpoint.Endpoint{ a("web.corp.internal", 300, "10.0.0.5"), endpoint.NewEndpointWithTTL("api.corp.internal", endpoint.RecordTypeCNAME, 60, "lb.corp.internal") },
+				UpdateOld: []*endpoint.Endpoint{ a("app.corp.internal", 300, "10.0.0.1") },
+				UpdateNew: []*endpoint.Endpoint{ a("app.corp.internal", 600, "10.0.0.1", "10.0.0.2") },
+				Delete:    []*endpoint.Endpoint{ a("old.corp.internal", 300, "10.0.0.9") },
+			},
+			want: "+ api.corp.internal CNAME: ttl 60 lb.corp.internal\n" +
+				"~ app.corp.internal A: ttl 300 10.0.0.1 => ttl 600 10.0.0.1;10.0.0.2\n" +
+				"- old.corp.internal A: ttl 300 10.0.0.9\n" +
+				"+ web.corp.internal A: ttl 300 10.0.0.5\n" +
+				"\nPlan: 2 to create, 1 to update, 1 to delete\n" },
+		{ name: "deletes only",
+			changes: &plan.Changes{ Delete: []*endpoint.Endpoint{ a("old.corp.internal", 300, "10.0.0.9") } },
+			want: "- old.corp.internal A: ttl 300 10.0.0.9\n\nPlan: 0 to create, 0 to update, 1 to delete\n" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			printPlan(&out, tt.changes)
+			if out.String() != tt.want {
+				t.Errorf("printPlan wrote\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunApplyRejectsPlans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		plan string
+		want string
+	}{
+		{ name: "not JSON", plan: "+ app.corp.internal A", want: "cannot read plan" },
+		{ name: "unpaired updates", plan: `{"UpdateOld":[{"dnsName":"app.corp.internal","recordType":"A","targets":["10.0.0.1"]}],"UpdateNew":[]}`, want: "UpdateOld & UpdateNew differ in length" },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "plan.json")
+			if err := ioutil.WriteFile(file, []byte(tt.plan), 0644); err != nil {
+				t.Fatal(err)
+			}
+			h := &fakeHandler{}
+			if err := runApply(h, file); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("runApply = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+	if err := runApply(&fakeHandler{}, filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("runApply of a missing plan = nil, want an error")
+	}
+}
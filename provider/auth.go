@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/Azure/go-autorest/autorest"
+	// Constants for interactions with Azure services (azure.*)
+	"github.com/Azure/go-autorest/autorest/azure"
+	// using environment-based authentication, call the NewAuthorizerFromEnvironment function to get your authorizer object.
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+
+	"k8s.io/klog/v2"
+)
+
+// AzureAuth selects where the providers read their Azure credentials from, independently of how the
+// controller connects to Kubernetes
+type AzureAuth string
+
+const (
+	// AzureAuthEnvironment reads the credentials from the environment, eg Pod Identity or AZURE_CLIENT_ID & AZURE_CLIENT_SECRET,
+	// the subscription is given to the provider
+	AzureAuthEnvironment AzureAuth = "env"
+	// AzureAuthFile reads the credentials & the subscription from the file in AZURE_AUTH_LOCATION, eg from 'az ad sp create-for-rbac --sdk-auth'
+	AzureAuthFile AzureAuth = "file"
+)
+
+// authorizer returns the authorizer & the subscription for the azureAuth mode, subID is the subscription for AzureAuthEnvironment
+func authorizer(azureAuth AzureAuth, subID string) (autorest.Authorizer, string, error) {
+	switch azureAuth {
+	case AzureAuthEnvironment:
+		klog.Info ("Get NewAuthorizerFromEnvironment (from Pod Identity)")
+		authorizer, err := auth.NewAuthorizerFromEnvironment()
+		if err != nil || authorizer == nil {
+			klog.Errorf("failed NewAuthorizerFromEnvironment: %+v", authorizer)
+			return nil, "", fmt.Errorf("failed NewAuthorizerFromEnvironment: %+v", authorizer)
+		}
+		return authorizer, subID, nil
+
+	case AzureAuthFile:
+		// Get Azure auth from azfile.json
+		authorizer, err := auth.NewAuthorizerFromFile(azure.PublicCloud.ResourceManagerEndpoint)
+		if err != nil ||  authorizer == nil {
+			return nil, "", fmt.Errorf("failed to read Azure authorizer with error: " + err.Error())
+		}
+
+		fs, err := auth.GetSettingsFromFile()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read Azure authorizer filesettings: " + err.Error())
+		}
+		return authorizer, fs.GetSubscriptionID(), nil
+	}
+	return nil, "", fmt.Errorf("unknown Azure auth %q, must be %s or %s", azureAuth, AzureAuthEnvironment, AzureAuthFile)
+}
@@ -6,13 +6,9 @@ import (
 	"fmt"
 	"context"
 	"strings"
+	"time"
 	// https://godoc.org/github.com/Azure/azure-sdk-for-go/services/privatedns/mgmt/2018-09-01/privatedns
 	"github.com/Azure/azure-sdk-for-go/services/privatedns/mgmt/2018-09-01/privatedns"
-	
-	"github.com/Azure/go-autorest/autorest"
-
-	// using environment-based authentication, call the NewAuthorizerFromEnvironment function to get your authorizer object.
-	"github.com/Azure/go-autorest/autorest/azure/auth"
 
 	// Constants for interactions with Azure services (azure.*)
 	"github.com/Azure/go-autorest/autorest/azure"
@@ -22,10 +18,14 @@ import (
 	"k8s.io/klog/v2"
 
 	"private-dns/endpoint"
+	"private-dns/metrics"
 	"private-dns/plan"
 )
 
 
+// privateProviderName labels the metrics of Azure Private DNS calls
+const privateProviderName = "azure-private-dns"
+
 // AzurePrivateProvider implements the DNS provider for Microsoft's Azure cloud platform.
 type AzurePrivateProvider struct {
 	dryRun        bool
@@ -35,33 +35,11 @@ type AzurePrivateProvider struct {
 }
 
 // NewAzurePrivateProvider - mimic the NewAzureProvider
-func NewAzurePrivateProvider (inCluster bool, resourceGroup string, subId string) (*AzurePrivateProvider, error) {
-	
-	// set environment variable to file location: AZURE_AUTH_LOCATION=./azauth.json
-	var authorizer autorest.Authorizer
-	var err error
-	var subscriptionID string
-
-	if inCluster {
-		klog.Info ("Get NewAuthorizerFromEnvironment (from Pod Identity)")
-		authorizer, err = auth.NewAuthorizerFromEnvironment()
-		if err != nil || authorizer == nil {
-			klog.Errorf("failed NewAuthorizerFromEnvironment: %+v", authorizer)
-			return nil, fmt.Errorf("failed NewAuthorizerFromEnvironment: %+v", authorizer)
-		}
-		subscriptionID = subId
-	} else {
-		// Get Azure auth from azfile.json
-		authorizer, err = auth.NewAuthorizerFromFile(azure.PublicCloud.ResourceManagerEndpoint)
-		if err != nil ||  authorizer == nil {
-			return nil, fmt.Errorf("failed to read Azure authorizer with error: " + err.Error())
-		}
+func NewAzurePrivateProvider (azureAuth AzureAuth, resourceGroup string, subId string) (*AzurePrivateProvider, error) {
 
-		fs, err := auth.GetSettingsFromFile()
-		if err != nil {
-			return nil, fmt.Errorf("failed to read Azure authorizer filesettings: " + err.Error())
-		}
-		subscriptionID = fs.GetSubscriptionID()
+	authorizer, subscriptionID, err := authorizer(azureAuth, subId)
+	if err != nil {
+		return nil, err
 	}
 
 	klog.Infof("Got Subscription %s", subscriptionID)
@@ -74,7 +52,7 @@ func NewAzurePrivateProvider (inCluster bool, resourceGroup string, subId string
 
 	provider := &AzurePrivateProvider{
 		resourceGroup:  resourceGroup,
-		dryRun: false,
+		dryRun: dryRunEnabled(),
 		privateZonesClient: privateZonesClient,
 		privateRecordsClient: privateRecordsClient,
 	}
@@ -83,26 +61,35 @@ func NewAzurePrivateProvider (inCluster bool, resourceGroup string, subId string
 }
 
 
-func (p *AzurePrivateProvider) privateZones() ([]privatedns.PrivateZone, error) {
+func (p *AzurePrivateProvider) privateZones(ctx context.Context) ([]privatedns.PrivateZone, error) {
 
 	var zones []privatedns.PrivateZone
 
 	// The API https://docs.microsoft.com/en-us/rest/api/dns/privatedns/privatezones/listbyresourcegroup
 	klog.Infof("Call ListByResourceGroupComplete with rg %s", p.resourceGroup)
-	for list, err := p.privateZonesClient.ListByResourceGroupComplete(context.Background(), p.resourceGroup, nil); list.NotDone(); err = list.Next() {
-		if err != nil {
-			klog.Error(err, "error traverising RG list")
-		}
+	timeout, _ := currentTimeouts()
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	list, err := p.privateZonesClient.ListByResourceGroupComplete(ctx, p.resourceGroup, nil)
+	for ; err == nil && list.NotDone(); err = list.NextWithContext(ctx) {
 
 		pzone := list.Value()
 		klog.Infof("Got %v,  %T\n",  *pzone.Name, pzone)
 
-		if pzone.Name == nil {
+		if pzone.Name == nil || !matchZone(*pzone.Name, to.String(pzone.ID), pzone.Tags) {
 			continue
 		}
 
 		zones = append(zones, pzone)
 	}
+	err = timeoutError(ctx, "listing the zones", timeout, err)
+	metrics.ObserveAzureCall(privateProviderName, "list_zones", start, err)
+	if err != nil {
+		klog.Error(err, "error traverising RG list")
+		return nil, err
+	}
+	zonesListed()
 
 	return zones, nil
 }
@@ -111,19 +98,19 @@ func (p *AzurePrivateProvider) privateZones() ([]privatedns.PrivateZone, error)
 // Records - Get current records inplace
 //
 // Records the current records or an error if the operation failed.
-func (p *AzurePrivateProvider) Records() (endpoints []*endpoint.Endpoint, _ error) {
-	zones, err := p.privateZones()
+func (p *AzurePrivateProvider) Records(ctx context.Context) (endpoints []*endpoint.Endpoint, _ error) {
+	zones, err := p.privateZones(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, zone := range zones {
 
-		for list, err := p.privateRecordsClient.ListComplete (context.Background(), p.resourceGroup, *zone.Name, nil, ""); list.NotDone(); err = list.Next() {
-			if err != nil {
-				klog.Error(err, "error traverising RG list")
-			}
-			
+		timeout, _ := currentTimeouts()
+		listCtx, cancel := withTimeout(ctx, timeout)
+		start := time.Now()
+		list, err := p.privateRecordsClient.ListComplete (listCtx, p.resourceGroup, *zone.Name, nil, "")
+		for ; err == nil && list.NotDone(); err = list.NextWithContext(listCtx) {
 			precord := list.Value()
 
 			if precord.Name == nil || precord.Type == nil {
@@ -151,7 +138,13 @@ func (p *AzurePrivateProvider) Records() (endpoints []*endpoint.Endpoint, _ erro
 				ttl = endpoint.TTL(*precord.TTL)
 			}
 
+			if !MatchDomain(name) {
+				klog.Infof("Skipping '%s', it is outside the domain filter.", name)
+				continue
+			}
+
 			ep := endpoint.NewEndpointWithTTL(name, recordType, endpoint.TTL(ttl), targets...)
+			ep.Labels = metadataLabels(precord.Metadata)
 			klog.Infof(
 				"Found %s record for '%s' with target '%s'.",
 				ep.RecordType,
@@ -161,50 +154,85 @@ func (p *AzurePrivateProvider) Records() (endpoints []*endpoint.Endpoint, _ erro
 			endpoints = append(endpoints, ep)
 
 		}
+		err = timeoutError(listCtx, "listing the records of zone "+*zone.Name, timeout, err)
+		cancel()
+		metrics.ObserveAzureCall(privateProviderName, "list_records", start, err)
+		if err != nil {
+			// a partial listing would look like missing records, so fail the whole listing
+			klog.Error(err, "error traverising record list")
+			return nil, err
+		}
 	}
 	return endpoints, nil
 }
 
+// Ping lists the zones, to check Azure DNS is reachable
+func (p *AzurePrivateProvider) Ping(ctx context.Context) error {
+	_, err := p.privateZones(ctx)
+	return err
+}
+
 // ApplyChanges applies the given changes.
 //
 // Returns nil if the operation was successful or an error if the operation failed.
 func (p *AzurePrivateProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
-	zones, err := p.privateZones()
+	zones, err := p.privateZones(ctx)
 	if err != nil {
 		return err
 	}
 
 
-	deleted, updated := p.mapChanges(zones, changes)
-	p.deleteRecords(deleted)
-	p.updateRecords(updated)
-	return nil
+	actions := recordActions(changes)
+	deleted, updated := p.mapChanges(ctx, zones, changes, actions)
+	// a failed delete is returned, so a finalizer waiting on it is kept until the record is gone, and a failed
+	// write so the key is retried
+	err = p.deleteRecords(ctx, deleted, actions)
+	if updateErr := p.updateRecords(ctx, updated, actions); err == nil {
+		err = updateErr
+	}
+	return err
 }
 
+// recordSetNameForZone returns the name of the endpoint relative to the zone, wildcards
+// keep their '*' label, eg '*.apps.corp.internal' in 'corp.internal' is '*.apps'
 func (p *AzurePrivateProvider) recordSetNameForZone(zone string, endpoint *endpoint.Endpoint) string {
-	// Remove the zone from the record set
-	name := endpoint.DNSName
-	name = name[:len(name)-len(zone)]
-	name = strings.TrimSuffix(name, ".")
+	name := strings.TrimSuffix(endpoint.DNSName, ".")
 
 	// For root, use @
-	if name == "" {
+	if strings.EqualFold(name, zone) {
 		return "@"
 	}
-	return name
+	// Remove the zone from the record set
+	return name[:len(name)-len(zone)-1]
 }
 
 
-func (p *AzurePrivateProvider) deleteRecords(deleted azurePrivateChangeMap) {
+func (p *AzurePrivateProvider) deleteRecords(ctx context.Context, deleted azurePrivateChangeMap, actions map[*endpoint.Endpoint]string) error {
 	// Delete records first
+	var failed error
 	for zone, endpoints := range deleted {
 		for _, endpoint := range endpoints {
 			name := p.recordSetNameForZone(zone, endpoint)
 			if p.dryRun {
 				klog.Infof("Would delete %s record named '%s' for Azure DNS zone '%s'.", endpoint.RecordType, name, zone)
+				if action, ok := actions[endpoint]; ok {
+					logDryRun(privateProviderName, action, zone, name, endpoint)
+				}
 			} else {
 				klog.Infof("Deleting %s record named '%s' for Azure DNS zone '%s'.", endpoint.RecordType, name, zone)
-				if _, err := p.privateRecordsClient.Delete(context.Background(), p.resourceGroup, zone, privatedns.RecordType(endpoint.RecordType), name, ""); err != nil {
+				_, writeTimeout := currentTimeouts()
+				callCtx, cancel := withTimeout(ctx, writeTimeout)
+				start := time.Now()
+				_, err := p.privateRecordsClient.Delete(callCtx, p.resourceGroup, zone, privatedns.RecordType(endpoint.RecordType), name, "")
+				err = timeoutError(callCtx, "deleting "+name+" in zone "+zone, writeTimeout, err)
+				cancel()
+				metrics.ObserveAzureCall(privateProviderName, "delete", start, err)
+				report(ctx, actions, endpoint, zone, name, err)
+				if err == nil {
+					if action, ok := actions[endpoint]; ok {
+						metrics.RecordChanged(zone, action)
+					}
+				} else {
 					klog.Errorf(
 						"Failed to delete %s record named '%s' for Azure DNS zone '%s': %v",
 						endpoint.RecordType,
@@ -212,13 +240,16 @@ func (p *AzurePrivateProvider) deleteRecords(deleted azurePrivateChangeMap) {
 						zone,
 						err,
 					)
+					failed = fmt.Errorf("failed to delete %s record named '%s' for Azure DNS zone '%s': %v", endpoint.RecordType, name, zone, err)
 				}
 			}
 		}
 	}
+	return failed
 }
 
-func (p *AzurePrivateProvider) updateRecords(updated azurePrivateChangeMap) {
+func (p *AzurePrivateProvider) updateRecords(ctx context.Context, updated azurePrivateChangeMap, actions map[*endpoint.Endpoint]string) error {
+	var failed error
 	for zone, endpoints := range updated {
 		for _, endpoint := range endpoints {
 			name := p.recordSetNameForZone(zone, endpoint)
@@ -230,6 +261,9 @@ func (p *AzurePrivateProvider) updateRecords(updated azurePrivateChangeMap) {
 					endpoint.Targets,
 					zone,
 				)
+				if action, ok := actions[endpoint]; ok {
+					logDryRun(privateProviderName, action, zone, name, endpoint)
+				}
 				continue
 			}
 
@@ -243,8 +277,11 @@ func (p *AzurePrivateProvider) updateRecords(updated azurePrivateChangeMap) {
 
 			recordSet, err := p.newRecordSet(endpoint)
 			if err == nil {
+				_, writeTimeout := currentTimeouts()
+				callCtx, cancel := withTimeout(ctx, writeTimeout)
+				start := time.Now()
 				_, err = p.privateRecordsClient.CreateOrUpdate(
-					context.Background(),
+					callCtx,
 					p.resourceGroup,
 					zone,
 					privatedns.RecordType(endpoint.RecordType),
@@ -252,7 +289,14 @@ func (p *AzurePrivateProvider) updateRecords(updated azurePrivateChangeMap) {
 					recordSet,
 					"",
 					"")
+				err = timeoutError(callCtx, "writing "+name+" in zone "+zone, writeTimeout, err)
+				cancel()
+				metrics.ObserveAzureCall(privateProviderName, "create_or_update", start, err)
+				if action, ok := actions[endpoint]; ok && err == nil {
+					metrics.RecordChanged(zone, action)
+				}
 			}
+			report(ctx, actions, endpoint, zone, name, err)
 			if err != nil {
 				klog.Errorf(
 					"Failed to update %s record named '%s' to '%s' for DNS zone '%s': %v",
@@ -262,9 +306,11 @@ func (p *AzurePrivateProvider) updateRecords(updated azurePrivateChangeMap) {
 					zone,
 					err,
 				)
+				failed = err
 			}
 		}
 	}
+	return failed
 }
 
 func (p *AzurePrivateProvider) newRecordSet(endpoint *endpoint.Endpoint) (privatedns.RecordSet, error) {
@@ -283,6 +329,7 @@ func (p *AzurePrivateProvider) newRecordSet(endpoint *endpoint.Endpoint) (privat
 		return privatedns.RecordSet{
 			RecordSetProperties: &privatedns.RecordSetProperties{
 				TTL:      to.Int64Ptr(ttl),
+				Metadata: recordMetadata(endpoint),
 				ARecords: &aRecords,
 			},
 		}, nil
@@ -290,6 +337,7 @@ func (p *AzurePrivateProvider) newRecordSet(endpoint *endpoint.Endpoint) (privat
 		return privatedns.RecordSet{
 			RecordSetProperties: &privatedns.RecordSetProperties{
 				TTL: to.Int64Ptr(ttl),
+				Metadata: recordMetadata(endpoint),
 				CnameRecord: &privatedns.CnameRecord{
 					Cname: to.StringPtr(endpoint.Targets[0]),
 				},
@@ -299,6 +347,7 @@ func (p *AzurePrivateProvider) newRecordSet(endpoint *endpoint.Endpoint) (privat
 		return privatedns.RecordSet{
 			RecordSetProperties: &privatedns.RecordSetProperties{
 				TTL: to.Int64Ptr(ttl),
+				Metadata: recordMetadata(endpoint),
 				TxtRecords: &[]privatedns.TxtRecord{
 					{
 						Value: &[]string{
@@ -318,7 +367,7 @@ func (p *AzurePrivateProvider) newRecordSet(endpoint *endpoint.Endpoint) (privat
 type azurePrivateChangeMap map[string][]*endpoint.Endpoint
 
 
-func (p *AzurePrivateProvider) mapChanges(zones []privatedns.PrivateZone, changes *plan.Changes) (azurePrivateChangeMap, azurePrivateChangeMap) {
+func (p *AzurePrivateProvider) mapChanges(ctx context.Context, zones []privatedns.PrivateZone, changes *plan.Changes, actions map[*endpoint.Endpoint]string) (azurePrivateChangeMap, azurePrivateChangeMap) {
 	ignored := map[string]bool{}
 	deleted := azurePrivateChangeMap{}
 	updated := azurePrivateChangeMap{}
@@ -329,12 +378,18 @@ func (p *AzurePrivateProvider) mapChanges(zones []privatedns.PrivateZone, change
 		}
 	}
 	mapChange := func(changeMap azurePrivateChangeMap, change *endpoint.Endpoint) {
+		if !MatchDomain(change.DNSName) {
+			klog.Infof("Ignoring changes to '%s' because it is outside the domain filter.", change.DNSName)
+			return
+		}
 		zone, _ := zoneNameIDMapper.FindZone(change.DNSName)
 		if zone == "" {
 			if _, ok := ignored[change.DNSName]; !ok {
 				ignored[change.DNSName] = true
 				klog.Infof("Ignoring changes to '%s' because a suitable Azure DNS zone was not found.", change.DNSName)
+				metrics.SkippedNoZone()
 			}
+			report(ctx, actions, change, "", "", nil)
 			return
 		}
 		// Ensure the record type is suitable
@@ -0,0 +1,39 @@
+package provider
+
+import (
+	"testing"
+
+	"private-dns/endpoint"
+)
+
+func TestRecordSetNameForZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		zone    string
+		dnsName string
+		want    string
+	}{
+		{ name: "record", zone: "corp.internal", dnsName: "app.corp.internal", want: "app" },
+		{ name: "nested record", zone: "corp.internal", dnsName: "app.team.corp.internal", want: "app.team" },
+		{ name: "trailing dot", zone: "corp.internal", dnsName: "app.corp.internal.", want: "app" },
+		{ name: "zone root", zone: "corp.internal", dnsName: "corp.internal", want: "@" },
+		{ name: "zone root with trailing dot", zone: "corp.internal", dnsName: "corp.internal.", want: "@" },
+		{ name: "zone root in another case", zone: "corp.internal", dnsName: "Corp.Internal", want: "@" },
+		{ name: "record in another case with trailing dot", zone: "corp.internal", dnsName: "App.Corp.Internal.", want: "App" },
+		{ name: "wildcard", zone: "corp.internal", dnsName: "*.corp.internal", want: "*" },
+		{ name: "nested wildcard", zone: "corp.internal", dnsName: "*.apps.corp.internal", want: "*.apps" },
+	}
+	private := &AzurePrivateProvider{}
+	public := &AzureProvider{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := &endpoint.Endpoint{ DNSName: tt.dnsName }
+			if got := private.recordSetNameForZone(tt.zone, ep); got != tt.want {
+				t.Errorf("private recordSetNameForZone(%q, %q) = %q, want %q", tt.zone, tt.dnsName, got, tt.want)
+			}
+			if got := public.recordSetNameForZone(tt.zone, ep); got != tt.want {
+				t.Errorf("public recordSetNameForZone(%q, %q) = %q, want %q", tt.zone, tt.dnsName, got, tt.want)
+			}
+		})
+	}
+}
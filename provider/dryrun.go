@@ -0,0 +1,78 @@
+package provider
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"private-dns/endpoint"
+)
+
+var (
+	dryRunMu sync.Mutex
+	dryRun   bool
+	// dryRunLog receives a JSON line for each change a dry run would have made
+	dryRunLog io.Writer
+)
+
+// SetDryRun makes the providers created afterwards write each change they would make to log, as JSON lines, instead of making it
+func SetDryRun(enabled bool, log io.Writer) {
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	dryRun = enabled
+	dryRunLog = log
+}
+
+func dryRunEnabled() bool {
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	return dryRun
+}
+
+// plannedChange is the JSON line written for a change a dry run would have made
+type plannedChange struct {
+	Time       string   `json:"time"`
+	Provider   string   `json:"provider"`
+	Action     string   `json:"action"`
+	Zone       string   `json:"zone"`
+	Name       string   `json:"name"`
+	DNSName    string   `json:"dnsName"`
+	RecordType string   `json:"recordType"`
+	Targets    []string `json:"targets"`
+	TTL        int64    `json:"ttl,omitempty"`
+	Owner      string   `json:"owner,omitempty"`
+	Resource   string   `json:"resource,omitempty"`
+}
+
+// logDryRun writes the change a dry run would have made to ep, as record name in zone
+func logDryRun(provider, action, zone, name string, ep *endpoint.Endpoint) {
+	line, err := json.Marshal(plannedChange{
+		Time: time.Now().UTC().Format(time.RFC3339),
+		Provider: provider,
+		Action: action,
+		Zone: zone,
+		Name: name,
+		DNSName: ep.DNSName,
+		RecordType: ep.RecordType,
+		Targets: ep.Targets,
+		TTL: int64(ep.RecordTTL),
+		Owner: ep.Labels[endpoint.OwnerLabelKey],
+		Resource: ep.Labels[endpoint.ResourceLabelKey],
+	})
+	if err != nil {
+		klog.Errorf("Failed to encode dry run change to %s: %v", ep.DNSName, err)
+		return
+	}
+
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	if dryRunLog == nil {
+		return
+	}
+	if _, err := dryRunLog.Write(append(line, '\n')); err != nil {
+		klog.Errorf("Failed to write dry run change to %s: %v", ep.DNSName, err)
+	}
+}
@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// DomainFilter restricts the record names the controller may manage
+type DomainFilter struct {
+	// Include are the domains that may be managed, with their subdomains, every domain when empty
+	Include []string
+	// Exclude are the domains never managed, with their subdomains, even below an Include domain
+	Exclude []string
+	// Regex must match a managed name when set
+	Regex *regexp.Regexp
+	// RegexExclusion must not match a managed name when set
+	RegexExclusion *regexp.Regexp
+}
+
+// ZoneFilter restricts the zones in the resource group the controller may manage, a zone must pass every filter that is set
+type ZoneFilter struct {
+	// Names of the zones
+	Names []string
+	// Tags the zone must carry, an empty value matches any value
+	Tags map[string]string
+	// IDs are the Azure resource IDs of the zones
+	IDs []string
+}
+
+var (
+	filterMu sync.RWMutex
+	domainFilter DomainFilter
+	zoneFilter ZoneFilter
+)
+
+// SetFilters restricts the zones listed & the record names read & changed by every provider
+func SetFilters(domains DomainFilter, zones ZoneFilter) {
+	filterMu.Lock()
+	defer filterMu.Unlock()
+	domainFilter = domains
+	zoneFilter = zones
+}
+
+func currentFilters() (DomainFilter, ZoneFilter) {
+	filterMu.RLock()
+	defer filterMu.RUnlock()
+	return domainFilter, zoneFilter
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// inDomain returns true if name is domain or below it
+func inDomain(name, domain string) bool {
+	domain = normalizeName(domain)
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// MatchDomain returns true if the record name may be managed under the domain filter
+func MatchDomain(name string) bool {
+	f, _ := currentFilters()
+	return f.match(normalizeName(name))
+}
+
+func (f DomainFilter) match(name string) bool {
+	for _, d := range f.Exclude {
+		if inDomain(name, d) {
+			return false
+		}
+	}
+	if f.Regex != nil && !f.Regex.MatchString(name) {
+		return false
+	}
+	if f.RegexExclusion != nil && f.RegexExclusion.MatchString(name) {
+		return false
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, d := range f.Include {
+		if inDomain(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchZone returns true if records may be managed in the zone, it must pass the zone filter & could hold a name
+// the domain filter includes
+func matchZone(name, id string, tags map[string]*string) bool {
+	domains, zones := currentFilters()
+	name = normalizeName(name)
+
+	if len(zones.Names) > 0 && !containsFold(zones.Names, name) {
+		klog.Infof("Skipping zone %s, not in the zone name filter", name)
+		return false
+	}
+	if len(zones.IDs) > 0 && !containsFold(zones.IDs, id) {
+		klog.Infof("Skipping zone %s, not in the zone ID filter", name)
+		return false
+	}
+	for k, v := range zones.Tags {
+		if tag, ok := tags[k]; !ok || tag == nil || (v != "" && *tag != v) {
+			klog.Infof("Skipping zone %s, it does not have the tag %s=%s", name, k, v)
+			return false
+		}
+	}
+
+	for _, d := range domains.Exclude {
+		if inDomain(name, d) {
+			klog.Infof("Skipping zone %s, it is in the excluded domain %s", name, d)
+			return false
+		}
+	}
+	if len(domains.Include) == 0 {
+		return true
+	}
+	for _, d := range domains.Include {
+		// the zone is below the included domain, or holds it
+		if inDomain(name, d) || inDomain(normalizeName(d), name) {
+			return true
+		}
+	}
+	klog.Infof("Skipping zone %s, it holds no domain in the domain filter", name)
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(strings.TrimSuffix(l, "."), s) {
+			return true
+		}
+	}
+	return false
+}
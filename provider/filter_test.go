@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestDomainFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter DomainFilter
+		record string
+		want   bool
+	}{
+		{ name: "empty filter matches everything", record: "app.corp.internal", want: true },
+		{ name: "included domain", filter: DomainFilter{ Include: []string{ "corp.internal" } }, record: "corp.internal", want: true },
+		{ name: "below included domain", filter: DomainFilter{ Include: []string{ "corp.internal" } }, record: "app.corp.internal", want: true },
+		{ name: "included domain with trailing dot", filter: DomainFilter{ Include: []string{ "corp.internal." } }, record: "app.corp.internal", want: true },
+		{ name: "suffix but not subdomain", filter: DomainFilter{ Include: []string{ "corp.internal" } }, record: "mycorp.internal", want: false },
+		{ name: "outside included domain", filter: DomainFilter{ Include: []string{ "corp.internal" } }, record: "app.other.internal", want: false },
+		{ name: "excluded below included", filter: DomainFilter{ Include: []string{ "corp.internal" }, Exclude: []string{ "legacy.corp.internal" } }, record: "app.legacy.corp.internal", want: false },
+		{ name: "excluded without include", filter: DomainFilter{ Exclude: []string{ "legacy.corp.internal" } }, record: "legacy.corp.internal", want: false },
+		{ name: "sibling of excluded", filter: DomainFilter{ Exclude: []string{ "legacy.corp.internal" } }, record: "app.corp.internal", want: true },
+		{ name: "regex matches", filter: DomainFilter{ Regex: regexp.MustCompile(`^[a-z]+\.corp\.internal$`) }, record: "app.corp.internal", want: true },
+		{ name: "regex does not match", filter: DomainFilter{ Regex: regexp.MustCompile(`^[a-z]+\.corp\.internal$`) }, record: "app1.corp.internal", want: false },
+		{ name: "regex exclusion matches", filter: DomainFilter{ RegexExclusion: regexp.MustCompile(`^test-`) }, record: "test-app.corp.internal", want: false },
+		{ name: "regex exclusion beats include", filter: DomainFilter{ Include: []string{ "corp.internal" }, RegexExclusion: regexp.MustCompile(`^test-`) }, record: "test-app.corp.internal", want: false },
+		{ name: "wildcard below included domain", filter: DomainFilter{ Include: []string{ "apps.corp.internal" } }, record: "*.apps.corp.internal", want: true },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.match(tt.record); got != tt.want {
+				t.Errorf("match(%q) = %v, want %v", tt.record, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	defer SetFilters(DomainFilter{}, ZoneFilter{})
+	SetFilters(DomainFilter{ Include: []string{ "corp.internal" } }, ZoneFilter{})
+
+	tests := []struct {
+		record string
+		want   bool
+	}{
+		{ record: "App.Corp.Internal.", want: true },
+		{ record: "app.corp.internal", want: true },
+		{ record: "app.other.internal", want: false },
+	}
+	for _, tt := range tests {
+		if got := MatchDomain(tt.record); got != tt.want {
+			t.Errorf("MatchDomain(%q) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
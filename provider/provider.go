@@ -20,6 +20,8 @@ import (
 	"context"
 	"net"
 	"strings"
+	"sync"
+	"time"
 	
 	"private-dns/endpoint"
 	"private-dns/plan"
@@ -27,8 +29,28 @@ import (
 
 // Provider defines the interface DNS providers should implement.
 type Provider interface {
-	Records() ([]*endpoint.Endpoint, error)
+	Records(ctx context.Context) ([]*endpoint.Endpoint, error)
 	ApplyChanges(ctx context.Context, changes *plan.Changes) error
+	// Ping checks the provider is reachable
+	Ping(ctx context.Context) error
+}
+
+var (
+	zonesListedMu sync.Mutex
+	zonesListedAt time.Time
+)
+
+func zonesListed() {
+	zonesListedMu.Lock()
+	defer zonesListedMu.Unlock()
+	zonesListedAt = time.Now()
+}
+
+// LastZoneListing returns when a provider last listed its zones successfully, zero if it never has
+func LastZoneListing() time.Time {
+	zonesListedMu.Lock()
+	defer zonesListedMu.Unlock()
+	return zonesListedAt
 }
 
 type contextKey struct {
@@ -42,6 +64,83 @@ func (k *contextKey) String() string { return "provider context value " + k.name
 // type []*endpoint.Endpoint.
 var RecordsContextKey = &contextKey{"records"}
 
+// resultsContextKey holds the *Results ApplyChanges reports to, see WithResults
+var resultsContextKey = &contextKey{"results"}
+
+// Result is what happened to one record in ApplyChanges
+type Result struct {
+	DNSName    string
+	RecordType string
+	Targets    []string
+	// Action is create, update or delete
+	Action string
+	// Zone & Name are the zone the record is in & its name in the zone, both empty if no zone matched
+	Zone string
+	Name string
+	Err  error
+}
+
+// Results collects the Result of each record changed by ApplyChanges
+type Results struct {
+	mu   sync.Mutex
+	list []Result
+}
+
+// List returns the results in the order the records were changed
+func (r *Results) List() []Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Result{}, r.list...)
+}
+
+// WithResults returns a context that collects the results of ApplyChanges calls made with it
+func WithResults(ctx context.Context) (context.Context, *Results) {
+	results := &Results{}
+	return context.WithValue(ctx, resultsContextKey, results), results
+}
+
+// report adds the Result of the change to ep, if ctx collects results, the old side of an update is not reported
+func report(ctx context.Context, actions map[*endpoint.Endpoint]string, ep *endpoint.Endpoint, zone, name string, err error) {
+	results, ok := ctx.Value(resultsContextKey).(*Results)
+	action, counted := actions[ep]
+	if !ok || !counted {
+		return
+	}
+
+	results.mu.Lock()
+	defer results.mu.Unlock()
+	results.list = append(results.list, Result{
+		DNSName: ep.DNSName,
+		RecordType: ep.RecordType,
+		Targets: ep.Targets,
+		Action: action,
+		Zone: zone,
+		Name: name,
+		Err: err,
+	})
+}
+
+// recordMetadata returns the endpoint's labels as Azure record set metadata, so ownership survives in the zone
+func recordMetadata(ep *endpoint.Endpoint) map[string]*string {
+	metadata := map[string]*string{}
+	for k, v := range ep.Labels {
+		value := v
+		metadata[k] = &value
+	}
+	return metadata
+}
+
+// metadataLabels returns the labels stored in Azure record set metadata by recordMetadata
+func metadataLabels(metadata map[string]*string) endpoint.Labels {
+	labels := endpoint.NewLabels()
+	for k, v := range metadata {
+		if v != nil {
+			labels[k] = *v
+		}
+	}
+	return labels
+}
+
 // ensureTrailingDot ensures that the hostname receives a trailing dot if it hasn't already.
 func ensureTrailingDot(hostname string) string {
 	if net.ParseIP(hostname) != nil {
@@ -49,4 +148,20 @@ func ensureTrailingDot(hostname string) string {
 	}
 
 	return strings.TrimSuffix(hostname, ".") + "."
-}
\ No newline at end of file
+}
+
+// recordActions returns the action each change is counted as in the metrics, the old side of an update
+// is deleted as part of the update so it is not counted
+func recordActions(changes *plan.Changes) map[*endpoint.Endpoint]string {
+	actions := map[*endpoint.Endpoint]string{}
+	for _, ep := range changes.Create {
+		actions[ep] = "create"
+	}
+	for _, ep := range changes.UpdateNew {
+		actions[ep] = "update"
+	}
+	for _, ep := range changes.Delete {
+		actions[ep] = "delete"
+	}
+	return actions
+}
@@ -0,0 +1,74 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	timeoutMu sync.RWMutex
+	// listTimeout limits a listing of the zones, or of the records in a zone, with every page
+	listTimeout = time.Minute
+	// writeTimeout limits a record set write or delete
+	writeTimeout = 30 * time.Second
+)
+
+// SetTimeouts sets the longest the providers wait for a listing & for a write or delete, 0 for no limit
+func SetTimeouts(list, write time.Duration) {
+	timeoutMu.Lock()
+	defer timeoutMu.Unlock()
+	listTimeout = list
+	writeTimeout = write
+}
+
+func currentTimeouts() (list, write time.Duration) {
+	timeoutMu.RLock()
+	defer timeoutMu.RUnlock()
+	return listTimeout, writeTimeout
+}
+
+// TimeoutError is returned for an Azure call that ran out of time, unlike most failures it is worth retrying as is
+type TimeoutError struct {
+	Operation string
+	After     time.Duration
+	Err       error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v: %v", e.Operation, e.After, e.Err)
+}
+
+// Unwrap returns the error the Azure call failed with
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout is always true, as for a net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// IsTimeout returns true if err is, or wraps, a TimeoutError
+func IsTimeout(err error) bool {
+	var t *TimeoutError
+	return errors.As(err, &t)
+}
+
+// withTimeout returns ctx limited to timeout, 0 leaves it as is
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError wraps the err of an Azure call made under ctx in a TimeoutError if ctx ran out of time
+func timeoutError(ctx context.Context, operation string, timeout time.Duration, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{ Operation: operation, After: timeout, Err: err }
+	}
+	return err
+}
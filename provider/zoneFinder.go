@@ -24,9 +24,11 @@ func (z zoneIDName) Add(zoneID, zoneName string) {
 	z[zoneID] = zoneName
 }
 
+// FindZone returns the zone with the longest name holding hostname, names are compared without case & trailing dots
 func (z zoneIDName) FindZone(hostname string) (suitableZoneID, suitableZoneName string) {
+	hostname = normalizeName(hostname)
 	for zoneID, zoneName := range z {
-		if hostname == zoneName || strings.HasSuffix(hostname, "."+zoneName) {
+		if name := normalizeName(zoneName); hostname == name || strings.HasSuffix(hostname, "."+name) {
 			if suitableZoneName == "" || len(zoneName) > len(suitableZoneName) {
 				suitableZoneID = zoneID
 				suitableZoneName = zoneName
@@ -0,0 +1,31 @@
+package provider
+
+import "testing"
+
+func TestFindZone(t *testing.T) {
+	zones := zoneIDName{}
+	zones.Add("corp.internal", "corp.internal")
+	zones.Add("apps.corp.internal", "apps.corp.internal")
+	zones.Add("Upper.Example", "Upper.Example")
+
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{ hostname: "app.corp.internal", want: "corp.internal" },
+		{ hostname: "corp.internal", want: "corp.internal" },
+		{ hostname: "web.apps.corp.internal", want: "apps.corp.internal" },
+		{ hostname: "*.apps.corp.internal", want: "apps.corp.internal" },
+		{ hostname: "App.Corp.Internal", want: "corp.internal" },
+		{ hostname: "app.corp.internal.", want: "corp.internal" },
+		{ hostname: "Web.Apps.Corp.Internal.", want: "apps.corp.internal" },
+		{ hostname: "app.upper.example", want: "Upper.Example" },
+		{ hostname: "app.mycorp.internal", want: "" },
+		{ hostname: "internal", want: "" },
+	}
+	for _, tt := range tests {
+		if got, _ := zones.FindZone(tt.hostname); got != tt.want {
+			t.Errorf("FindZone(%q) = %q, want %q", tt.hostname, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"private-dns/handler"
+	"private-dns/provider"
+)
+
+// syncStatus is written to the handler.StatusAnnotation of an object after its records change
+type syncStatus struct {
+	Records []recordStatus `json:"records"`
+	// Result is Synced, NoZone, TemplateFailed or Failed, with the names or error in Message
+	Result   string `json:"result"`
+	Message  string `json:"message,omitempty"`
+	LastSync string `json:"lastSync"`
+}
+
+// recordStatus is a record published by the object, Zone & Name are empty until a change to it succeeds
+type recordStatus struct {
+	FQDN    string   `json:"fqdn"`
+	Type    string   `json:"type"`
+	Targets []string `json:"targets"`
+	Zone    string   `json:"zone,omitempty"`
+	Name    string   `json:"name,omitempty"`
+}
+
+var resultVerbs = map[string]string{ "create": "Created", "update": "Updated", "delete": "Deleted" }
+
+// report emits the Events & writes the status of a sync of key that changed records, failed with err or
+// found a new template failure in warning
+func (c *Controller) report(key string, obj meta_v1.Object, gvr schema.GroupVersionResource, desired []handler.DNSEntry, results []provider.Result, warning, err error) {
+	if len(results) == 0 && err == nil && warning == nil {
+		return
+	}
+	if warning != nil {
+		c.event(obj, core_v1.EventTypeWarning, "TemplateFailed", "Skipped the records named by the fqdn template: %v", warning)
+	}
+
+	status := syncStatus{ Result: "Synced", LastSync: time.Now().UTC().Format(time.RFC3339) }
+	noZone := []string{}
+	failed := err != nil
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed = true
+			c.event(obj, core_v1.EventTypeWarning, failedReason(r.Err), "Failed to %s %s record %s in zone %s: %v", r.Action, r.RecordType, r.DNSName, r.Zone, r.Err)
+		case r.Zone == "":
+			noZone = append(noZone, r.DNSName)
+			c.event(obj, core_v1.EventTypeWarning, "NoZone", "Skipped %s record %s, a suitable Azure DNS zone was not found", r.RecordType, r.DNSName)
+		default:
+			c.setZone(r)
+			c.event(obj, core_v1.EventTypeNormal, "Record"+resultVerbs[r.Action], "%s %s record %s in zone %s with targets %s", resultVerbs[r.Action], r.RecordType, r.Name, r.Zone, strings.Join(r.Targets, ","))
+		}
+	}
+	switch {
+	case failed:
+		status.Result = "Failed"
+		if err != nil {
+			status.Message = err.Error()
+		}
+		if err != nil && len(results) == 0 {
+			c.event(obj, core_v1.EventTypeWarning, failedReason(err), "Failed to sync records: %v", err)
+		}
+	case warning != nil:
+		status.Result = "TemplateFailed"
+		status.Message = warning.Error()
+	case len(noZone) > 0:
+		status.Result = "NoZone"
+		status.Message = "no suitable Azure DNS zone was found for " + strings.Join(noZone, ", ")
+	}
+
+	if !c.writeStatus || obj == nil || obj.GetDeletionTimestamp() != nil {
+		return
+	}
+	status.Records = []recordStatus{}
+	for _, e := range desired {
+		zone := c.getZone(e.FQDN())
+		status.Records = append(status.Records, recordStatus{ FQDN: e.FQDN(), Type: e.RecordType(), Targets: e.Targets(), Zone: zone.Zone, Name: zone.Name })
+	}
+	if err := c.setStatus(obj, gvr, status); err != nil {
+		klog.Errorf("Error writing the status of %s: %v", key, err)
+	}
+}
+
+// newWarning returns the template failure of key, nil if it is the one already reported, the last reported
+// failure is forgotten once the template succeeds, so a later failure is reported again
+func (c *Controller) newWarning(key string, templateErr *handler.TemplateError) error {
+	c.warnedMu.Lock()
+	defer c.warnedMu.Unlock()
+	if templateErr == nil {
+		delete(c.warned, key)
+		return nil
+	}
+	if c.warned[key] == templateErr.Error() {
+		return nil
+	}
+	c.warned[key] = templateErr.Error()
+	return templateErr
+}
+
+// failedReason returns the reason of the Warning Event for err, SyncTimeout when an Azure call ran out of time
+func failedReason(err error) string {
+	if provider.IsTimeout(err) {
+		return "SyncTimeout"
+	}
+	return "SyncFailed"
+}
+
+// event emits an Event on obj, if Events are enabled, keys without an object are only logged
+func (c *Controller) event(obj meta_v1.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	klog.Infof("%s: "+messageFmt, append([]interface{}{reason}, args...)...)
+	if c.recorder == nil || obj == nil {
+		return
+	}
+	if o, ok := obj.(runtime.Object); ok {
+		c.recorder.Eventf(o, eventType, reason, messageFmt, args...)
+	}
+}
+
+func (c *Controller) setZone(r provider.Result) {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	if r.Action == "delete" {
+		delete(c.zones, r.DNSName)
+		return
+	}
+	c.zones[r.DNSName] = r
+}
+
+func (c *Controller) getZone(fqdn string) provider.Result {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	return c.zones[fqdn]
+}
+
+// setStatus patches the handler.StatusAnnotation of obj with status
+func (c *Controller) setStatus(obj meta_v1.Object, gvr schema.GroupVersionResource, status syncStatus) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{ handler.StatusAnnotation: string(value) },
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.dynamicClient.Resource(gvr).Namespace(obj.GetNamespace()).Patch(obj.GetName(), types.MergePatchType, patch, meta_v1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch %s %s/%s: %v", gvr.Resource, obj.GetNamespace(), obj.GetName(), err)
+	}
+	return nil
+}
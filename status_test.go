@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"private-dns/handler"
+)
+
+func TestNewWarning(t *testing.T) {
+	c := &Controller{ warned: map[string]string{} }
+	missing := &handler.TemplateError{ Object: "default/web", Err: errors.New("map has no entry for key \"team\"") }
+	other := &handler.TemplateError{ Object: "default/web", Err: errors.New("map has no entry for key \"env\"") }
+
+	steps := []struct {
+		name string
+		err  *handler.TemplateError
+		want bool
+	}{
+		{ name: "first failure is reported", err: missing, want: true },
+		{ name: "same failure is not reported again", err: missing, want: false },
+		{ name: "a different failure is reported", err: other, want: true },
+		{ name: "success", err: nil, want: false },
+		{ name: "failure after a success is reported again", err: other, want: true },
+	}
+	for _, s := range steps {
+		if got := c.newWarning("default/web", s.err) != nil; got != s.want {
+			t.Errorf("%s: newWarning reported = %v, want %v", s.name, got, s.want)
+		}
+	}
+	if got := c.newWarning("default/api", missing); got == nil {
+		t.Errorf("newWarning(default/api) = nil, want the failure reported for another key")
+	}
+}